@@ -2,49 +2,61 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andfenastari/chatsim/core"
+	"github.com/andfenastari/chatsim/shell/api"
 	"github.com/davecgh/go-spew/spew"
 )
 
 type CreateMessageTest struct {
 	Sender    string
-	Message   *Message
-	InitState *State
-	EndState  *State
-	Response  *CreateMessageResponse
+	Message   *core.Message
+	InitState *core.Snapshot
+	EndState  *core.Snapshot
 }
 
 func TestCreateMessage(t *testing.T) {
 	tests := []CreateMessageTest{
 		{
 			Sender: "+00",
-			Message: &Message{
+			Message: &core.Message{
 				To:   "+11",
 				Type: "text",
-				Text: &TextMessage{
+				Text: &core.TextMessage{
 					Body: "Sup?",
 				},
 			},
-			Response:  newCreateMessageResponse("+11"),
-			InitState: &State{},
-			EndState: &State{
-				Chats: []*Chat{
-					&Chat{
-						User: "+11",
-						Messages: []*Message{
+			InitState: &core.Snapshot{},
+			EndState: &core.Snapshot{
+				Chats: []*core.Chat{
+					{
+						Members: [2]string{"+00", "+11"},
+						Messages: []*core.Message{
 							{
+								From: "+00",
 								To:   "+11",
 								Type: "text",
-								Text: &TextMessage{
+								Text: &core.TextMessage{
 									Body: "Sup?",
 								},
+								Status: core.StatusSent,
 							},
 						},
 					},
@@ -53,26 +65,33 @@ func TestCreateMessage(t *testing.T) {
 		},
 		{
 			Sender: "+11",
-			Message: &Message{
+			Message: &core.Message{
 				To:   "+00",
 				Type: "text",
-				Text: &TextMessage{
+				Text: &core.TextMessage{
 					Body: "Sup?",
 				},
 			},
-			Response:  newCreateMessageResponse("+00"),
-			InitState: &State{},
-			EndState: &State{
-				Chats: []*Chat{
-					&Chat{
-						User: "+11",
-						Messages: []*Message{
+			InitState: &core.Snapshot{
+				Chats: []*core.Chat{
+					{
+						Members: [2]string{"+00", "+11"},
+					},
+				},
+			},
+			EndState: &core.Snapshot{
+				Chats: []*core.Chat{
+					{
+						Members: [2]string{"+00", "+11"},
+						Messages: []*core.Message{
 							{
+								From: "+11",
 								To:   "+00",
 								Type: "text",
-								Text: &TextMessage{
+								Text: &core.TextMessage{
 									Body: "Sup?",
 								},
+								Status: core.StatusSent,
 							},
 						},
 					},
@@ -81,35 +100,36 @@ func TestCreateMessage(t *testing.T) {
 		},
 		{
 			Sender: "+00",
-			Message: &Message{
+			Message: &core.Message{
 				To:   "+22",
 				Type: "text",
-				Text: &TextMessage{
+				Text: &core.TextMessage{
 					Body: "Sup?",
 				},
 			},
-			Response: newCreateMessageResponse("+22"),
-			InitState: &State{
-				Chats: []*Chat{
+			InitState: &core.Snapshot{
+				Chats: []*core.Chat{
 					{
-						User: "+11",
+						Members: [2]string{"+00", "+11"},
 					},
 				},
 			},
-			EndState: &State{
-				Chats: []*Chat{
+			EndState: &core.Snapshot{
+				Chats: []*core.Chat{
 					{
-						User: "+11",
+						Members: [2]string{"+00", "+11"},
 					},
 					{
-						User: "+22",
-						Messages: []*Message{
+						Members: [2]string{"+00", "+22"},
+						Messages: []*core.Message{
 							{
+								From: "+00",
 								To:   "+22",
 								Type: "text",
-								Text: &TextMessage{
+								Text: &core.TextMessage{
 									Body: "Sup?",
 								},
+								Status: core.StatusSent,
 							},
 						},
 					},
@@ -122,9 +142,17 @@ func TestCreateMessage(t *testing.T) {
 		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
 
 			// Arrange
-			server := newServer(test.InitState)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SetSnapshot(*test.InitState)
+			server := api.NewHandler(c)
 			w := httptest.NewRecorder()
-			msg, err := json.Marshal(test.Message)
+			msg, err := json.Marshal(api.CreateMessageRequest{
+				MessagingProduct: "whatsapp",
+				Message:          test.Message,
+			})
 			body := bytes.NewReader(msg)
 			req := httptest.NewRequest("POST", "/"+test.Sender+"/messages", body)
 
@@ -137,19 +165,1163 @@ func TestCreateMessage(t *testing.T) {
 				t.Fatalf("Response status mismatch. Expected 200, got %v", result.StatusCode)
 			}
 
-			var res *CreateMessageResponse
+			var res *api.CreateMessageResponse
 			err = json.NewDecoder(result.Body).Decode(&res)
 			if err != nil {
-				t.Errorf("Failed to decode body. %v", err)
+				t.Fatalf("Failed to decode body. %v", err)
+			}
+
+			c.RLock()
+			defer c.RUnlock()
+
+			created := c.Chats[len(c.Chats)-1]
+			sent := created.Messages[len(created.Messages)-1]
+			if sent.Id == "" || sent.Timestamp == 0 {
+				t.Errorf("Message was not assigned an id and timestamp: %+v", sent)
+			}
+
+			response := &api.CreateMessageResponse{
+				MessagingProduct: "whatsapp",
+				Contacts:         []api.Contact{{Input: test.Message.To, WaId: test.Message.To}},
+				Messages:         []api.CreatedMessage{{Id: sent.Id}},
+			}
+			if !reflect.DeepEqual(response, res) {
+				t.Errorf("Response mismatch. Expected %+v, got %+v", response, res)
+			}
+
+			test.EndState.Version = core.SnapshotVersion
+			expected := test.EndState.Chats[len(test.EndState.Chats)-1]
+			expected.Messages[len(expected.Messages)-1].Id = sent.Id
+			expected.Messages[len(expected.Messages)-1].Timestamp = sent.Timestamp
+
+			if !reflect.DeepEqual(*test.EndState, c.Snapshot) {
+				t.Errorf("State mismatch. Expected %s, got %s", spew.Sdump(test.EndState), spew.Sdump(c.Snapshot))
+			}
+		})
+	}
+}
+
+type AuthenticationTest struct {
+	Path          string
+	Authorization string
+	Status        int
+	Code          int
+}
+
+func TestAuthentication(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	snapshot := core.Snapshot{
+		PhoneNumbers: []*core.PhoneNumber{{Id: "1055", Number: "+00"}},
+		AccessTokens: []*core.AccessToken{
+			{Token: "valid", Number: "+00"},
+			{Token: "other", Number: "+11"},
+			{Token: "expired", Number: "+00", Expires: &expired},
+		},
+	}
+
+	tests := []AuthenticationTest{
+		{Path: "/+00/messages", Authorization: "", Status: http.StatusUnauthorized, Code: 190},
+		{Path: "/+00/messages", Authorization: "Bearer invalid", Status: http.StatusUnauthorized, Code: 190},
+		{Path: "/+00/messages", Authorization: "Bearer expired", Status: http.StatusUnauthorized, Code: 190},
+		{Path: "/+00/messages", Authorization: "Bearer other", Status: http.StatusBadRequest, Code: 100},
+		{Path: "/+00/messages", Authorization: "Bearer valid", Status: http.StatusOK},
+		{Path: "/v19.0/1055/messages", Authorization: "Bearer valid", Status: http.StatusOK},
+		{Path: "/v99.0/1055/messages", Authorization: "Bearer valid", Status: http.StatusBadRequest, Code: 2500},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SetSnapshot(snapshot)
+			server := api.NewHandler(c)
+			w := httptest.NewRecorder()
+			body := strings.NewReader(`{"messaging_product":"whatsapp","to":"+11","type":"text","text":{"body":"Sup?"}}`)
+			req := httptest.NewRequest("POST", test.Path, body)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+
+			// Act
+			server.ServeHTTP(w, req)
+
+			// Assert
+			result := w.Result()
+			if result.StatusCode != test.Status {
+				t.Fatalf("Response status mismatch. Expected %v, got %v", test.Status, result.StatusCode)
+			}
+
+			if test.Code == 0 {
+				return
+			}
+
+			var res struct {
+				Error api.GraphError `json:"error"`
+			}
+			err := json.NewDecoder(result.Body).Decode(&res)
+			if err != nil {
+				t.Fatalf("Failed to decode body. %v", err)
+			}
+
+			if res.Error.Code != test.Code {
+				t.Errorf("Error code mismatch. Expected %v, got %+v", test.Code, res.Error)
+			}
+		})
+	}
+}
+
+type BusinessAccountTest struct {
+	Method        string
+	Path          string
+	Authorization string
+	Status        int
+	Code          int
+	Body          string
+}
+
+func TestBusinessAccounts(t *testing.T) {
+	snapshot := core.Snapshot{
+		BusinessAccounts: []*core.BusinessAccount{{Id: "waba", Name: "Acme"}},
+		PhoneNumbers: []*core.PhoneNumber{
+			{Id: "1055", Number: "+00", AccountId: "waba", DisplayName: "Acme Sales"},
+			{Id: "1066", Number: "+22", AccountId: "waba"},
+		},
+		AccessTokens: []*core.AccessToken{
+			{Token: "account", AccountId: "waba"},
+			{Token: "sales", Number: "+00"},
+		},
+	}
+
+	tests := []BusinessAccountTest{
+		{Method: "POST", Path: "/1055/messages", Authorization: "Bearer account", Status: http.StatusOK},
+		{Method: "POST", Path: "/+22/messages", Authorization: "Bearer account", Status: http.StatusOK},
+		{Method: "POST", Path: "/+22/messages", Authorization: "Bearer sales", Status: http.StatusBadRequest, Code: 100},
+		{Method: "POST", Path: "/+11/messages", Authorization: "Bearer account", Status: http.StatusBadRequest, Code: 100},
+		{
+			Method: "GET", Path: "/waba/phone_numbers", Authorization: "Bearer account", Status: http.StatusOK,
+			Body: `{"data":[{"id":"1055","display_phone_number":"+00","verified_name":"Acme Sales","quality_rating":"GREEN"},{"id":"1066","display_phone_number":"+22","verified_name":"+22","quality_rating":"GREEN"}]}`,
+		},
+		{Method: "GET", Path: "/waba/phone_numbers", Authorization: "Bearer sales", Status: http.StatusBadRequest, Code: 100},
+		{Method: "GET", Path: "/other/phone_numbers", Authorization: "Bearer account", Status: http.StatusBadRequest, Code: 100},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SetSnapshot(snapshot)
+			server := api.NewHandler(c)
+			w := httptest.NewRecorder()
+			body := strings.NewReader(`{"messaging_product":"whatsapp","to":"+11","type":"text","text":{"body":"Sup?"}}`)
+			req := httptest.NewRequest(test.Method, test.Path, body)
+			req.Header.Set("Authorization", test.Authorization)
+
+			// Act
+			server.ServeHTTP(w, req)
+
+			// Assert
+			result := w.Result()
+			if result.StatusCode != test.Status {
+				t.Fatalf("Response status mismatch. Expected %v, got %v", test.Status, result.StatusCode)
+			}
+
+			data, _ := io.ReadAll(result.Body)
+			if test.Body != "" && strings.TrimSpace(string(data)) != test.Body {
+				t.Errorf("Response body mismatch. Expected %s, got %s", test.Body, data)
+			}
+
+			if test.Code == 0 {
+				return
+			}
+
+			var res struct {
+				Error api.GraphError `json:"error"`
+			}
+			err := json.Unmarshal(data, &res)
+			if err != nil {
+				t.Fatalf("Failed to decode body. %v", err)
+			}
+
+			if res.Error.Code != test.Code {
+				t.Errorf("Error code mismatch. Expected %v, got %+v", test.Code, res.Error)
+			}
+		})
+	}
+}
+
+type ValidationTest struct {
+	Body string
+	Code int
+}
+
+func TestCreateMessageValidation(t *testing.T) {
+	snapshot := core.Snapshot{
+		Media: []*core.Media{
+			{Id: "image", User: "+00", Type: "PNG"},
+			{Id: "audio", User: "+00", Type: "MP3"},
+		},
+		Chats: []*core.Chat{
+			{Members: [2]string{"+00", "+11"}, Messages: []*core.Message{{Id: "wamid.11", From: "+11", To: "+00", Type: "text"}}},
+			{Members: [2]string{"+00", "+22"}, Messages: []*core.Message{{Id: "wamid.22", From: "+22", To: "+00", Type: "text"}}},
+		},
+	}
+
+	tests := []ValidationTest{
+		{Body: `{"to":"+11","type":"text","text":{"body":"Sup?"}}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","type":"text","text":{"body":"Sup?"}}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"text","text":{"body":""}}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"text","text":{"body":"` + strings.Repeat("a", 4097) + `"}}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"image"}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"image","image":{"id":"missing"}}`, Code: 131053},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"image","image":{"id":"audio"}}`, Code: 131053},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"audio","audio":{"id":"audio","caption":"Sup?"}}`, Code: 131009},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"sticker","sticker":{"id":"image"}}`, Code: 131051},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"reaction","reaction":{"emoji":"👍"}}`, Code: 100},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"reaction","reaction":{"message_id":"wamid.22","emoji":"👍"}}`, Code: 131009},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"image","image":{"id":"image","caption":"Sup?"}}`},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","type":"reaction","reaction":{"message_id":"wamid.11","emoji":"👍"}}`},
+		{Body: `{"messaging_product":"whatsapp","to":"+11","text":{"body":"Sup?"}}`},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SetSnapshot(snapshot)
+			server := api.NewHandler(c)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/+00/messages", strings.NewReader(test.Body))
+
+			// Act
+			server.ServeHTTP(w, req)
+
+			// Assert
+			result := w.Result()
+			if test.Code == 0 {
+				if result.StatusCode != http.StatusOK {
+					t.Fatalf("Response status mismatch. Expected 200, got %v", result.StatusCode)
+				}
+				return
+			}
+
+			if result.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Response status mismatch. Expected 400, got %v", result.StatusCode)
+			}
+
+			var res struct {
+				Error api.GraphError `json:"error"`
+			}
+			err := json.NewDecoder(result.Body).Decode(&res)
+			if err != nil {
+				t.Fatalf("Failed to decode body. %v", err)
+			}
+
+			if res.Error.Code != test.Code || res.Error.ErrorData == nil {
+				t.Errorf("Error mismatch. Expected code %v, got %+v", test.Code, res.Error)
+			}
+		})
+	}
+}
+
+func TestDownloadMediaRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Media with inline data predate the media store, and are moved into it
+	// when the snapshot is set.
+	c := core.NewCore(ctx)
+	c.SetSnapshot(core.Snapshot{
+		Media: []*core.Media{{Id: "audio", User: "+00", Type: "MP3", Data: []byte("0123456789")}},
+	})
+	server := api.NewHandler(c)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/audio/download", nil)
+	req.Header.Set("Range", "bytes=2-4")
+
+	server.ServeHTTP(w, req)
+
+	result := w.Result()
+	body, _ := io.ReadAll(result.Body)
+	if result.StatusCode != http.StatusPartialContent || string(body) != "234" {
+		t.Errorf("Expected partial content '234', got %v '%s'", result.StatusCode, body)
+	}
+	if c.Media[0].Data != nil || c.Media[0].Size != 10 {
+		t.Errorf("Expected media to be moved to the store, got %+v", c.Media[0])
+	}
+}
+
+type AdminTest struct {
+	Path          string
+	Body          string
+	Authorization string
+	Status        int
+	Response      api.AdminResponse
+}
+
+func TestAdmin(t *testing.T) {
+	tests := []AdminTest{
+		{
+			Path:     "/_admin/reset",
+			Status:   http.StatusOK,
+			Response: api.AdminResponse{Success: true, Webhooks: 1},
+		},
+		{
+			Path:     "/_admin/reset?clear_webhooks=true",
+			Status:   http.StatusOK,
+			Response: api.AdminResponse{Success: true},
+		},
+		{
+			Path:     "/_admin/seed",
+			Body:     `{"chats": [{"participants": ["+00", "+11"], "messages": []}, {"participants": ["+00", "+22"], "messages": []}]}`,
+			Status:   http.StatusOK,
+			Response: api.AdminResponse{Success: true, Chats: 2, Webhooks: 1},
+		},
+		{
+			Path:   "/_admin/seed",
+			Body:   `{"chats": `,
+			Status: http.StatusBadRequest,
+		},
+		{
+			Path:   "/_admin/seed?format=rar",
+			Body:   `{}`,
+			Status: http.StatusBadRequest,
+		},
+		{
+			Path:   "/_admin/reset?clear_webhooks=maybe",
+			Status: http.StatusBadRequest,
+		},
+		// The access tokens of the numbers do not grant access.
+		{
+			Path:          "/_admin/reset",
+			Authorization: "Bearer secret",
+			Status:        http.StatusUnauthorized,
+		},
+		{
+			Path:          "/_admin/seed",
+			Body:          `{"access_tokens": [{"number": "+99", "token": "mine"}]}`,
+			Authorization: "Bearer secret",
+			Status:        http.StatusUnauthorized,
+		},
+		{
+			Path:          "/_admin/reset",
+			Authorization: "Bearer none",
+			Status:        http.StatusUnauthorized,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SetSnapshot(core.Snapshot{
+				Chats:        []*core.Chat{{Members: [2]string{"+00", "+33"}}},
+				AccessTokens: []*core.AccessToken{{Number: "+00", Token: "secret"}},
+			})
+			c.AddWebhook(&core.Webhook{User: "+00", URL: "http://localhost:1"})
+			server := api.NewHandler(c)
+			server.AdminToken = "admin"
+
+			// The listener only counts the events of the request.
+			c.Flush()
+			listener := c.AddListener(core.ListenerOptions{
+				Filter: core.EventFilter{Types: []core.EventType{core.EventReset, core.EventSnapshotLoaded}},
+			})
+			defer c.RemoveListener(listener)
+			for c.ListenerStats().Listeners < 2 {
+				time.Sleep(time.Millisecond)
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", test.Path, strings.NewReader(test.Body))
+			req.Header.Set("Authorization", cmp.Or(test.Authorization, "Bearer admin"))
+
+			// Act
+			server.ServeHTTP(w, req)
+
+			// Assert
+			result := w.Result()
+			if result.StatusCode != test.Status {
+				body, _ := io.ReadAll(result.Body)
+				t.Fatalf("Expected status %d, got %d: %s", test.Status, result.StatusCode, body)
+			}
+			if test.Status != http.StatusOK {
+				return
+			}
+
+			var response api.AdminResponse
+			json.NewDecoder(result.Body).Decode(&response)
+			if response != test.Response {
+				t.Errorf("Expected response %+v, got %+v", test.Response, response)
+			}
+
+			// The listeners are notified before the response is sent.
+			if len(listener.C) != 1 {
+				t.Errorf("Expected the listener to be notified, %d events buffered", len(listener.C))
+			}
+
+			if c.GetAccessToken("secret") == nil {
+				t.Error("Expected the access tokens to be kept")
+			}
+		})
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := core.NewCore(ctx)
+	c.SetSnapshot(core.Snapshot{Chats: []*core.Chat{{Members: [2]string{"+00", "+33"}}}})
+	server := api.NewHandler(c)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/_admin/reset", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected the admin endpoints to be disabled without an admin token, got %d", w.Code)
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.Chats) != 1 {
+		t.Error("Expected the state to be kept")
+	}
+}
+
+type DrainTest struct {
+	Status  int
+	Pending int
+}
+
+func TestDrainWebhooks(t *testing.T) {
+	tests := []DrainTest{
+		{Status: http.StatusOK, Pending: 0},
+		{Status: http.StatusInternalServerError, Pending: 1},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+				w.WriteHeader(test.Status)
+			}))
+			defer endpoint.Close()
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			_, err := server.RegisterWebhook(ctx, &core.Webhook{User: "+11", URL: endpoint.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Lock()
+			c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), &core.Message{
+				From: "+00",
+				To:   "+11",
+				Type: "text",
+				Text: &core.TextMessage{Body: "Bye"},
+			})
+			c.Unlock()
+
+			// Act
+			drainCtx, cancelDrain := context.WithTimeout(ctx, time.Second)
+			defer cancelDrain()
+			pending := server.Drain(drainCtx)
+
+			// Assert
+			if pending != test.Pending {
+				t.Errorf("Expected %d pending deliveries, got %d", test.Pending, pending)
 			}
+		})
+	}
+}
 
-			if !reflect.DeepEqual(test.Response, res) {
-				t.Errorf("Response mismatch. Expected %+v, got %+v", test.Response, res)
+type VerifyWebhookTest struct {
+	// Reply answers the verification request with the challenge sent.
+	Reply func(w http.ResponseWriter, r *http.Request, challenge string)
+	Valid bool
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	tests := []VerifyWebhookTest{
+		{
+			Reply: func(w http.ResponseWriter, r *http.Request, challenge string) {
+				w.Write([]byte(challenge))
+			},
+			Valid: true,
+		},
+		{
+			Reply: func(w http.ResponseWriter, r *http.Request, challenge string) {
+				w.Write([]byte(challenge + "0"))
+			},
+			Valid: false,
+		},
+		{
+			Reply: func(w http.ResponseWriter, r *http.Request, challenge string) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(challenge))
+			},
+			Valid: false,
+		},
+		{
+			// A receiver that never answers is bounded by the timeout.
+			Reply: func(w http.ResponseWriter, r *http.Request, challenge string) {
+				<-r.Context().Done()
+			},
+			Valid: false,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			queries := make(chan url.Values, 1)
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				queries <- r.URL.Query()
+				test.Reply(w, r, r.URL.Query().Get("hub.challenge"))
+			}))
+			defer endpoint.Close()
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			server.Timeout = 100 * time.Millisecond
+
+			// Act
+			start := time.Now()
+			_, err := server.RegisterWebhook(ctx, &core.Webhook{User: "+11", URL: endpoint.URL, VerifyToken: "token"})
+
+			// Assert
+			if test.Valid && err != nil {
+				t.Fatalf("Expected the webhook to be registered, got %v", err)
+			}
+			if !test.Valid && err == nil {
+				t.Fatal("Expected the verification to fail")
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Expected the verification to time out, took %v", elapsed)
+			}
+			query := <-queries
+			if query.Get("hub.mode") != "subscribe" || query.Get("hub.verify_token") != "token" {
+				t.Errorf("Unexpected verification request %v", query)
+			}
+
+			c.RLock()
+			defer c.RUnlock()
+			if registered := len(c.Webhooks) == 1; registered != test.Valid {
+				t.Errorf("Expected the webhook to be registered: %v, got %d webhooks", test.Valid, len(c.Webhooks))
+			}
+		})
+	}
+}
+
+type BackoffTest struct {
+	Failures int
+	Backoff  time.Duration
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := api.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []BackoffTest{
+		{Failures: 0, Backoff: time.Second},
+		{Failures: 1, Backoff: time.Second},
+		{Failures: 2, Backoff: 2 * time.Second},
+		{Failures: 3, Backoff: 4 * time.Second},
+		{Failures: 4, Backoff: 8 * time.Second},
+		{Failures: 5, Backoff: 10 * time.Second},
+		{Failures: 100, Backoff: 10 * time.Second},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+			if backoff := policy.Backoff(test.Failures); backoff != test.Backoff {
+				t.Errorf("Expected a backoff of %v after %d failures, got %v", test.Backoff, test.Failures, backoff)
+			}
+		})
+	}
+}
+
+type RetryTest struct {
+	// Statuses are the replies to the successive attempts, the last one
+	// being repeated.
+	Statuses []int
+	State    string
+	Attempts int
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []RetryTest{
+		{Statuses: []int{http.StatusOK}, State: core.DeliveryDelivered, Attempts: 1},
+		{Statuses: []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK}, State: core.DeliveryDelivered, Attempts: 3},
+		{Statuses: []int{http.StatusInternalServerError}, State: core.DeliveryFailed},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var attempts atomic.Int32
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+					return
+				}
+				n := int(attempts.Add(1))
+				w.WriteHeader(test.Statuses[min(n, len(test.Statuses))-1])
+			}))
+			defer endpoint.Close()
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			server.Retry = api.RetryPolicy{
+				InitialBackoff: 10 * time.Millisecond,
+				MaxBackoff:     20 * time.Millisecond,
+				MaxAge:         200 * time.Millisecond,
+			}
+			id, err := server.RegisterWebhook(ctx, &core.Webhook{User: "+11", URL: endpoint.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			msg := &core.Message{
+				From: "+00",
+				To:   "+11",
+				Type: "text",
+				Text: &core.TextMessage{Body: "Hi"},
+			}
+			c.Lock()
+			c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), msg)
+			c.Unlock()
+
+			drainCtx, cancelDrain := context.WithTimeout(ctx, 2*time.Second)
+			defer cancelDrain()
+			server.Drain(drainCtx)
+
+			// Assert
+			c.RLock()
+			defer c.RUnlock()
+
+			deliveries := c.WebhookDeliveries(id)
+			if len(deliveries) != 1 {
+				t.Fatalf("Expected 1 delivery, got %s", spew.Sdump(deliveries))
+			}
+			delivery := deliveries[0]
+			if delivery.State != test.State {
+				t.Errorf("Expected the delivery to be %s, got %s", test.State, delivery.State)
+			}
+			if test.Attempts > 0 && delivery.AttemptCount != test.Attempts {
+				t.Errorf("Expected %d attempts, got %d", test.Attempts, delivery.AttemptCount)
+			}
+			if test.State == core.DeliveryFailed && delivery.AttemptCount < 2 {
+				t.Errorf("Expected the delivery to be retried before giving up, got %d attempts", delivery.AttemptCount)
+			}
+
+			// Only delivered messages are marked as such.
+			status := core.StatusSent
+			if test.State == core.DeliveryDelivered {
+				status = core.StatusDelivered
+			}
+			if msg.Status != status {
+				t.Errorf("Expected the message to be %s, got %s", status, msg.Status)
+			}
+		})
+	}
+}
+
+// Webhooks restored from the journal resume their pending deliveries once
+// the handler is created.
+func TestWebhookResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bodies := make(chan string, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer endpoint.Close()
+
+	c := core.NewCore(ctx)
+	c.Lock()
+	webhook := &core.Webhook{User: "+11", URL: endpoint.URL}
+	c.AddWebhook(webhook)
+	c.AddDelivery(webhook, &core.Event{Type: core.EventMessageCreated}, []byte(`{"restored":true}`))
+	c.Unlock()
+
+	server := api.NewHandler(c)
+	drainCtx, cancelDrain := context.WithTimeout(ctx, time.Second)
+	defer cancelDrain()
+	if pending := server.Drain(drainCtx); pending != 0 {
+		t.Fatalf("Expected the restored delivery to be sent, %d pending", pending)
+	}
+
+	if body := <-bodies; body != `{"restored":true}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+}
+
+type SignatureTest struct {
+	AppSecret    string
+	BadSignature bool
+	Signature    string
+}
+
+// Receivers check the X-Hub-Signature-256 header against the body they
+// received, with the secret of the app.
+func TestWebhookSignature(t *testing.T) {
+	tests := []SignatureTest{
+		{AppSecret: "", Signature: "none"},
+		{AppSecret: "secret", Signature: "valid"},
+		{AppSecret: "secret", BadSignature: true, Signature: "invalid"},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			signatures := make(chan string, 1)
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+					return
+				}
+
+				header := r.Header.Get("X-Hub-Signature-256")
+				body, _ := io.ReadAll(r.Body)
+
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write(body)
+				expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+				switch {
+				case header == "":
+					signatures <- "none"
+				case hmac.Equal([]byte(header), []byte(expected)):
+					signatures <- "valid"
+				default:
+					signatures <- "invalid"
+				}
+			}))
+			defer endpoint.Close()
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			_, err := server.RegisterWebhook(ctx, &core.Webhook{
+				User:         "+11",
+				URL:          endpoint.URL,
+				AppSecret:    test.AppSecret,
+				BadSignature: test.BadSignature,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			c.Lock()
+			c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), &core.Message{
+				From: "+00",
+				To:   "+11",
+				Type: "text",
+				Text: &core.TextMessage{Body: "Hi"},
+			})
+			c.Unlock()
+
+			// Assert
+			select {
+			case signature := <-signatures:
+				if signature != test.Signature {
+					t.Errorf("Expected a %s signature, got a %s one", test.Signature, signature)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for the webhook")
+			}
+		})
+	}
+}
+
+// A receiver that never answers only holds back its own deliveries.
+func TestHungWebhook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			return
+		}
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	received := make(chan struct{}, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			return
+		}
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	c := core.NewCore(ctx)
+	server := api.NewHandler(c)
+	server.Timeout = time.Minute
+	for _, endpoint := range []*httptest.Server{hung, fast} {
+		if _, err := server.RegisterWebhook(ctx, &core.Webhook{User: "+11", URL: endpoint.URL}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		c.Lock()
+		c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), &core.Message{
+			From: "+00",
+			To:   "+11",
+			Type: "text",
+			Text: &core.TextMessage{Body: fmt.Sprint(i)},
+		})
+		c.Unlock()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected adding messages not to wait for the webhooks, took %v", elapsed)
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for message %d on the other webhook", i)
+		}
+	}
+}
+
+type QueueTest struct {
+	QueueSize int
+	Messages  int
+	Pending   int
+	Dropped   int
+}
+
+// Deliveries to a receiver that does not keep up are dropped once its queue
+// is full, and logged as failed.
+func TestWebhookQueue(t *testing.T) {
+	tests := []QueueTest{
+		{QueueSize: 10, Messages: 5, Pending: 5, Dropped: 0},
+		{QueueSize: 2, Messages: 5, Pending: 2, Dropped: 3},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			release := make(chan struct{})
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "GET" {
+					w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+					return
+				}
+				<-release
+			}))
+			defer endpoint.Close()
+			defer close(release)
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			server.Timeout = time.Minute
+			server.QueueSize = test.QueueSize
+			id, err := server.RegisterWebhook(ctx, &core.Webhook{User: "+11", URL: endpoint.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			for i := 0; i < test.Messages; i++ {
+				c.Lock()
+				c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), &core.Message{
+					From: "+00",
+					To:   "+11",
+					Type: "text",
+					Text: &core.TextMessage{Body: fmt.Sprint(i)},
+				})
+				c.Unlock()
+			}
+
+			// Assert
+			var deliveries []*core.Delivery
+			deadline := time.Now().Add(time.Second)
+			for len(deliveries) < test.Messages && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+				c.RLock()
+				deliveries = c.WebhookDeliveries(id)
+				c.RUnlock()
+			}
+
+			c.RLock()
+			defer c.RUnlock()
+
+			pending, dropped := 0, 0
+			for _, delivery := range deliveries {
+				switch {
+				case delivery.State == core.DeliveryPending:
+					pending++
+				case delivery.State == core.DeliveryFailed && len(delivery.Attempts) == 1 && delivery.Attempts[0].Error == "Delivery queue is full":
+					dropped++
+				}
+			}
+			if pending != test.Pending || dropped != test.Dropped {
+				t.Errorf("Expected %d pending and %d dropped deliveries, got %s", test.Pending, test.Dropped, spew.Sdump(deliveries))
+			}
+		})
+	}
+}
+
+type StatusWebhookTest struct {
+	MessageFailureRate float64
+	MarkRead           bool
+	Statuses           []core.Status
+}
+
+// The sender of a message is notified of its status changes through the
+// "statuses" field of its webhooks.
+func TestStatusWebhooks(t *testing.T) {
+	undeliverable := core.NewError(core.ErrUndeliverable, "Injected failure.")
+	tests := []StatusWebhookTest{
+		{
+			Statuses: []core.Status{
+				{Status: core.StatusSent, RecipientId: "+11"},
+			},
+		},
+		{
+			MarkRead: true,
+			Statuses: []core.Status{
+				{Status: core.StatusSent, RecipientId: "+11"},
+				{Status: core.StatusDelivered, RecipientId: "+11"},
+				{Status: core.StatusRead, RecipientId: "+11"},
+			},
+		},
+		{
+			MessageFailureRate: 1,
+			Statuses: []core.Status{
+				{Status: core.StatusSent, RecipientId: "+11"},
+				{Status: core.StatusFailed, RecipientId: "+11", Errors: []*core.Error{undeliverable}},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			server := api.NewHandler(c)
+			server.Faults.MessageFailureRate = test.MessageFailureRate
+
+			// The statuses are reported to the sender, and the message to
+			// the recipient.
+			register := func(user string) chan []byte {
+				payloads := make(chan []byte, 10)
+				endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == "GET" {
+						w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+						return
+					}
+					body, _ := io.ReadAll(r.Body)
+					payloads <- body
+				}))
+				t.Cleanup(endpoint.Close)
+
+				if _, err := server.RegisterWebhook(ctx, &core.Webhook{User: user, URL: endpoint.URL}); err != nil {
+					t.Fatal(err)
+				}
+				return payloads
+			}
+			payloads := register("+00")
+			received := register("+11")
+
+			// Act
+			w := httptest.NewRecorder()
+			body := `{"messaging_product":"whatsapp","to":"+11","type":"text","text":{"body":"Hi"}}`
+			server.ServeHTTP(w, httptest.NewRequest("POST", "/+00/messages", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Failed to send the message: %s", w.Body)
+			}
+			var res api.CreateMessageResponse
+			json.NewDecoder(w.Body).Decode(&res)
+			id := res.Messages[0].Id
+
+			if test.MarkRead {
+				w := httptest.NewRecorder()
+				body := fmt.Sprintf(`{"messaging_product":"whatsapp","status":"read","message_id":"%s"}`, id)
+				server.ServeHTTP(w, httptest.NewRequest("POST", "/+11/messages", strings.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("Failed to mark the message as read: %s", w.Body)
+				}
+			}
+
+			// Assert
+			var statuses []core.Status
+			for range test.Statuses {
+				var payload struct {
+					Entry []struct {
+						Changes []struct {
+							Value struct {
+								Statuses []core.Status `json:"statuses"`
+							} `json:"value"`
+						} `json:"changes"`
+					} `json:"entry"`
+				}
+
+				select {
+				case body := <-payloads:
+					if err := json.Unmarshal(body, &payload); err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Timed out waiting for the statuses, got %s", spew.Sdump(statuses))
+				}
+
+				for _, status := range payload.Entry[0].Changes[0].Value.Statuses {
+					if status.Id != id || status.Timestamp == 0 {
+						t.Errorf("Unexpected status %+v of message '%s'", status, id)
+					}
+					status.Id, status.Timestamp = "", 0
+					statuses = append(statuses, status)
+				}
+			}
+
+			if !reflect.DeepEqual(statuses, test.Statuses) {
+				t.Errorf("Statuses mismatch. Expected %s, got %s", spew.Sdump(test.Statuses), spew.Sdump(statuses))
+			}
+
+			var payload struct {
+				Entry []struct {
+					Changes []struct {
+						Value struct {
+							Messages []map[string]any `json:"messages"`
+						} `json:"value"`
+					} `json:"changes"`
+				} `json:"entry"`
+			}
+			select {
+			case body := <-received:
+				if err := json.Unmarshal(body, &payload); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for the message")
+			}
+
+			msg := payload.Entry[0].Changes[0].Value.Messages[0]
+			if msg["id"] != id {
+				t.Errorf("Expected message '%s', got %v", id, msg)
+			}
+			for _, key := range []string{"status", "error"} {
+				if _, found := msg[key]; found {
+					t.Errorf("Expected the message to have no %s, got %v", key, msg)
+				}
+			}
+		})
+	}
+}
+
+type SnapshotAccessTest struct {
+	Method        string
+	Path          string
+	Authorization string
+	Status        int
+}
+
+func TestSnapshotEndpointsRequireAdmin(t *testing.T) {
+	tests := []SnapshotAccessTest{
+		{Method: "GET", Path: "/snapshot/files", Authorization: "Bearer admin", Status: http.StatusOK},
+		{Method: "GET", Path: "/snapshot/files", Authorization: "Bearer secret", Status: http.StatusUnauthorized},
+		{Method: "GET", Path: "/snapshot/history", Authorization: "", Status: http.StatusUnauthorized},
+		{Method: "POST", Path: "/snapshot/reset", Authorization: "Bearer secret", Status: http.StatusUnauthorized},
+		{Method: "POST", Path: "/snapshot/reload", Authorization: "Bearer secret", Status: http.StatusUnauthorized},
+		{Method: "POST", Path: "/snapshot/files/state.json/load", Authorization: "Bearer secret", Status: http.StatusUnauthorized},
+		{Method: "POST", Path: "/snapshot/reset", Authorization: "Bearer admin", Status: http.StatusOK},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.SnapshotPath = filepath.Join(t.TempDir(), "state.json")
+			c.SetSnapshot(core.Snapshot{
+				Chats:        []*core.Chat{{Members: [2]string{"+00", "+33"}}},
+				AccessTokens: []*core.AccessToken{{Number: "+00", Token: "secret"}},
+			})
+			if err := c.SaveSnapshot(c.SnapshotPath); err != nil {
+				t.Fatal(err)
+			}
+			server := api.NewHandler(c)
+			server.AdminToken = "admin"
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(test.Method, test.Path, nil)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+
+			// Act
+			server.ServeHTTP(w, req)
+
+			// Assert
+			if w.Code != test.Status {
+				t.Fatalf("Expected status %d, got %d: %s", test.Status, w.Code, w.Body)
 			}
 
-			if !reflect.DeepEqual(test.EndState, server.State) {
-				log.Print("OK")
-				t.Errorf("State mismatch. Expected %s, got %s", spew.Sdump(test.EndState), spew.Sdump(server.State))
+			c.RLock()
+			defer c.RUnlock()
+			if test.Status != http.StatusOK && len(c.Chats) != 1 {
+				t.Error("Expected a rejected request to keep the state")
 			}
 		})
 	}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// commands are the subcommands of chatsim, run instead of the servers when
+// their name is the first argument.
+var commands = map[string]func(args []string){
+	"snapshot": snapshotCommand,
+	"config":   configCommand,
+}
+
+func snapshotCommand(args []string) {
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintf(os.Stderr, "USAGE: %s snapshot migrate [flag]... <snapshot>...\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	flags := flag.NewFlagSet("snapshot migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s snapshot migrate [flag]... <snapshot>...\nUpgrades snapshots to version %d in place.\nAvailable flags:\n", os.Args[0], core.SnapshotVersion)
+		flags.PrintDefaults()
+	}
+	owner := flags.String("user", core.LegacyOwner, "Number owning the chats of version 0 snapshots, which only recorded the peer of each chat.")
+	flags.Parse(args[1:])
+
+	core.LegacyOwner = *owner
+
+	failed := false
+	for _, path := range flags.Args() {
+		from, err := core.MigrateSnapshotFile(path)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		case from == core.SnapshotVersion:
+			fmt.Printf("%s: already at version %d\n", path, from)
+		default:
+			fmt.Printf("%s: migrated from version %d to %d\n", path, from, core.SnapshotVersion)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func configCommand(args []string) {
+	if len(args) < 2 || args[0] != "validate" {
+		fmt.Fprintf(os.Stderr, "USAGE: %s config validate <config>...\nChecks configuration files, reporting errors with their line numbers.\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, path := range args[1:] {
+		// Values such as the snapshot path may be given with flags, so
+		// they are not required in the file.
+		config := DefaultConfig()
+		file, errs := ReadConfig(path, &config)
+		if file != nil {
+			errs = append(errs, file.Locate(config.ValidateFile(), flag.NewFlagSet(path, flag.ContinueOnError))...)
+		}
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		if len(errs) > 0 {
+			failed = true
+		} else {
+			fmt.Printf("%s: valid\n", path)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andfenastari/chatsim/core"
+	"github.com/andfenastari/chatsim/shell/api"
+)
+
+// Config configures the chatsim servers. It is read from the JSON file given
+// with the -config flag, and the flags given on the command line override
+// the values of the file.
+type Config struct {
+	APIAddr string `json:"api_addr"`
+	WebAddr string `json:"web_addr"`
+	Devel   bool   `json:"devel"`
+
+	// User is the business number the customers talk to by default in the
+	// web interface, and Users the simulated customers, which are given a
+	// chat with it on startup.
+	User  string   `json:"user"`
+	Users []string `json:"users"`
+
+	Snapshot        string   `json:"snapshot"`
+	MediaDir        string   `json:"media_dir"`
+	History         int      `json:"history"`
+	Journal         string   `json:"journal"`
+	CompactInterval Duration `json:"compact_interval"`
+	Watch           Duration `json:"watch"`
+	SaveOnExit      bool     `json:"save_on_exit"`
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// BusinessAccounts are the business accounts, PhoneNumbers their
+	// business numbers, and Tokens the API access tokens of either. They are
+	// added to every snapshot loaded.
+	BusinessAccounts []*core.BusinessAccount `json:"business_accounts"`
+	PhoneNumbers     []*core.PhoneNumber     `json:"phone_numbers"`
+	Tokens           []*core.AccessToken     `json:"tokens"`
+
+	// AdminToken grants access to the endpoints that replace or expose the
+	// whole state, which are disabled without it.
+	AdminToken string `json:"admin_token"`
+
+	// VerifyToken and AppSecret are used by the webhooks that do not set
+	// their own.
+	Webhooks    []*WebhookConfig `json:"webhooks"`
+	VerifyToken string           `json:"verify_token"`
+	AppSecret   string           `json:"app_secret"`
+
+	WebhookRetry   RetryConfig  `json:"webhook_retry"`
+	WebhookTimeout Duration     `json:"webhook_timeout"`
+	WebhookQueue   int          `json:"webhook_queue"`
+	Faults         FaultsConfig `json:"faults"`
+}
+
+type WebhookConfig struct {
+	User         string `json:"user"`
+	URL          string `json:"url"`
+	VerifyToken  string `json:"verify_token"`
+	AppSecret    string `json:"app_secret"`
+	BadSignature bool   `json:"bad_signature"`
+}
+
+type RetryConfig struct {
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	MaxAge         Duration `json:"max_age"`
+}
+
+// FaultsConfig injects failures into webhook deliveries and messages.
+// BadSignature signs the payloads of every webhook with an invalid signature.
+type FaultsConfig struct {
+	Delay              Duration `json:"delay"`
+	FailureRate        float64  `json:"failure_rate"`
+	MessageFailureRate float64  `json:"message_failure_rate"`
+	BadSignature       bool     `json:"bad_signature"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		APIAddr:         ":8000",
+		WebAddr:         ":8001",
+		User:            "agent",
+		History:         core.DefaultHistorySize,
+		CompactInterval: Duration(5 * time.Minute),
+		ShutdownTimeout: Duration(10 * time.Second),
+		WebhookRetry: RetryConfig{
+			InitialBackoff: Duration(api.DefaultRetryPolicy.InitialBackoff),
+			MaxBackoff:     Duration(api.DefaultRetryPolicy.MaxBackoff),
+			MaxAge:         Duration(api.DefaultRetryPolicy.MaxAge),
+		},
+		WebhookTimeout: Duration(api.DefaultTimeout),
+		WebhookQueue:   api.DefaultQueueSize,
+	}
+}
+
+// Flags registers a flag for the values of c that can be set from the command
+// line, using the current values as defaults.
+func (c *Config) Flags(flags *flag.FlagSet) {
+	flags.StringVar(&c.APIAddr, "api-addr", c.APIAddr, "API server address.")
+	flags.StringVar(&c.WebAddr, "web-addr", c.WebAddr, "Web interface server address.")
+
+	flags.StringVar(&c.Snapshot, "snapshot", c.Snapshot, "Path of the snapshot to load")
+	flags.IntVar(&c.History, "history", c.History, "Number of previous snapshots kept when saving. Set to 0 to disable.")
+	flags.StringVar(&c.Journal, "journal", c.Journal, "Path of a journal recording every change as it happens, which is replayed on top of the snapshot on startup. It also keeps the webhooks and their pending deliveries across restarts. Disabled by default.")
+	flags.Var(&c.CompactInterval, "compact-interval", "Interval at which the journal is compacted into the snapshot.")
+	flags.Var(&c.Watch, "watch", "Interval at which the snapshot file is checked for changes, reloading it when edited by hand. Example: '1s'. Disabled by default.")
+	flags.StringVar(&c.MediaDir, "media-dir", c.MediaDir, "Directory where media blobs are stored. Defaults to the snapshot path with a '.media' extension.")
+	flags.StringVar(&c.User, "user", c.User, "Web server user.")
+	flags.BoolVar(&c.SaveOnExit, "save-on-exit", c.SaveOnExit, "Save the snapshot when exiting on SIGINT or SIGTERM. Implied by 'journal'.")
+	flags.Var(&c.ShutdownTimeout, "shutdown-timeout", "Time given to running requests and pending webhook deliveries to finish when exiting.")
+
+	flags.BoolVar(&c.Devel, "devel", c.Devel, "Turn on development mode.")
+	flags.Var(webhooksFlag{&c.Webhooks}, "webhooks", "A comma separated list of '<user>:<url>' values to send webhooks to. URLs without a scheme use http. Example: 'agent:localhost:9000,other:https://example.com/hook'")
+	flags.StringVar(&c.VerifyToken, "verify-token", c.VerifyToken, "Verify token sent when verifying the webhook endpoints.")
+	flags.StringVar(&c.AppSecret, "app-secret", c.AppSecret, "App secret used to sign the payloads sent to the webhook endpoints.")
+	flags.Var(&c.WebhookRetry.InitialBackoff, "webhook-retry-initial", "Delay before retrying a failed webhook delivery. Doubles after each failure.")
+	flags.Var(&c.WebhookRetry.MaxBackoff, "webhook-retry-max", "Maximum delay between webhook delivery attempts.")
+	flags.Var(&c.WebhookRetry.MaxAge, "webhook-retry-age", "Time after which failed webhook deliveries are not retried anymore.")
+	flags.Var(&c.WebhookTimeout, "webhook-timeout", "Timeout of each webhook request.")
+	flags.IntVar(&c.WebhookQueue, "webhook-queue", c.WebhookQueue, "Maximum number of pending deliveries of each webhook. Further deliveries are dropped.")
+	flags.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "Access token of the admin endpoints, which reset, seed, load and download the state. The endpoints are disabled without it.")
+	flags.Var(tokensFlag{&c.Tokens}, "tokens", "A comma separated list of '<user>=<token>' API access tokens. When any token is configured, API requests must be authenticated. Example: 'agent=secret,other=secret2'")
+}
+
+// flagFields maps the flags registered by Config.Flags to the fields of the
+// configuration file they override.
+var flagFields = map[string]string{
+	"api-addr":              "api_addr",
+	"web-addr":              "web_addr",
+	"snapshot":              "snapshot",
+	"history":               "history",
+	"journal":               "journal",
+	"compact-interval":      "compact_interval",
+	"watch":                 "watch",
+	"media-dir":             "media_dir",
+	"user":                  "user",
+	"save-on-exit":          "save_on_exit",
+	"shutdown-timeout":      "shutdown_timeout",
+	"devel":                 "devel",
+	"webhooks":              "webhooks",
+	"verify-token":          "verify_token",
+	"app-secret":            "app_secret",
+	"webhook-retry-initial": "webhook_retry.initial_backoff",
+	"webhook-retry-max":     "webhook_retry.max_backoff",
+	"webhook-retry-age":     "webhook_retry.max_age",
+	"webhook-timeout":       "webhook_timeout",
+	"webhook-queue":         "webhook_queue",
+	"tokens":                "tokens",
+	"admin-token":           "admin_token",
+}
+
+// Validate checks the values of c, returning an error per invalid value.
+func (c *Config) Validate() []*ConfigError {
+	return c.validate(true)
+}
+
+// ValidateFile checks the values of a configuration file, which may leave
+// out the values that can be given with flags.
+func (c *Config) ValidateFile() []*ConfigError {
+	return c.validate(false)
+}
+
+func (c *Config) validate(complete bool) []*ConfigError {
+	var errs []*ConfigError
+	invalid := func(field string, msg string, args ...any) {
+		errs = append(errs, &ConfigError{Field: field, Err: fmt.Errorf(msg, args...)})
+	}
+
+	if c.APIAddr == "" {
+		invalid("api_addr", "Missing API server address")
+	}
+	if c.WebAddr == "" {
+		invalid("web_addr", "Missing web server address")
+	}
+	if c.APIAddr != "" && c.APIAddr == c.WebAddr {
+		invalid("web_addr", "The web server address '%s' is the API server address", c.WebAddr)
+	}
+	if complete && c.Snapshot == "" {
+		invalid("snapshot", "Missing snapshot path")
+	}
+	if c.User == "" {
+		invalid("user", "Missing web server user")
+	}
+	for i, user := range c.Users {
+		if user == "" {
+			invalid(fmt.Sprintf("users[%d]", i), "Missing number")
+		}
+	}
+
+	if c.History < 0 {
+		invalid("history", "Negative history size %d", c.History)
+	}
+	if c.CompactInterval <= 0 {
+		invalid("compact_interval", "The compaction interval must be positive")
+	}
+	if c.Watch < 0 {
+		invalid("watch", "Negative watch interval")
+	}
+	if c.ShutdownTimeout < 0 {
+		invalid("shutdown_timeout", "Negative shutdown timeout")
+	}
+
+	accounts := map[string]bool{}
+	for i, account := range c.BusinessAccounts {
+		field := fmt.Sprintf("business_accounts[%d]", i)
+		switch {
+		case account == nil || account.Id == "":
+			invalid(field, "Missing business account id")
+		case accounts[account.Id]:
+			invalid(field+".id", "Duplicate business account id '%s'", account.Id)
+		}
+		if account != nil {
+			accounts[account.Id] = true
+		}
+	}
+
+	// Accounts may also come from the snapshot, so the phone numbers are
+	// only checked against the accounts of the file when it has any.
+	ids := map[string]bool{}
+	for i, phone := range c.PhoneNumbers {
+		field := fmt.Sprintf("phone_numbers[%d]", i)
+		switch {
+		case phone == nil || phone.Id == "":
+			invalid(field, "Missing phone number id")
+		case phone.Number == "":
+			invalid(field+".number", "Missing number")
+		case ids[phone.Id]:
+			invalid(field+".id", "Duplicate phone number id '%s'", phone.Id)
+		case len(accounts) > 0 && !accounts[phone.AccountId]:
+			invalid(field+".account_id", "Unknown business account '%s'", phone.AccountId)
+		}
+		if phone != nil {
+			ids[phone.Id] = true
+		}
+	}
+
+	for i, token := range c.Tokens {
+		field := fmt.Sprintf("tokens[%d]", i)
+		switch {
+		case token == nil || token.Token == "":
+			invalid(field, "Missing token")
+		case token.Number == "" && token.AccountId == "":
+			invalid(field+".number", "Missing number or business account id")
+		case len(accounts) > 0 && token.AccountId != "" && !accounts[token.AccountId]:
+			invalid(field+".account_id", "Unknown business account '%s'", token.AccountId)
+		}
+	}
+
+	for i, webhook := range c.Webhooks {
+		field := fmt.Sprintf("webhooks[%d]", i)
+		if webhook == nil || webhook.User == "" {
+			invalid(field, "Missing webhook user")
+			continue
+		}
+
+		u, err := url.Parse(webhook.URL)
+		switch {
+		case err != nil:
+			invalid(field+".url", "Invalid url '%s': %v", webhook.URL, err)
+		case u.Scheme != "http" && u.Scheme != "https":
+			invalid(field+".url", "Invalid url '%s': the scheme must be http or https", webhook.URL)
+		case u.Host == "":
+			invalid(field+".url", "Invalid url '%s': missing host", webhook.URL)
+		}
+	}
+
+	if c.WebhookRetry.InitialBackoff <= 0 || c.WebhookRetry.MaxBackoff <= 0 {
+		invalid("webhook_retry", "The retry backoffs must be positive")
+	}
+	if c.WebhookTimeout <= 0 {
+		invalid("webhook_timeout", "The webhook timeout must be positive")
+	}
+	if c.WebhookQueue <= 0 {
+		invalid("webhook_queue", "The webhook queue size must be positive")
+	}
+	if c.Faults.Delay < 0 {
+		invalid("faults.delay", "Negative delay")
+	}
+	if c.Faults.FailureRate < 0 || c.Faults.FailureRate > 1 {
+		invalid("faults.failure_rate", "The failure rate %v is not between 0 and 1", c.Faults.FailureRate)
+	}
+	if c.Faults.MessageFailureRate < 0 || c.Faults.MessageFailureRate > 1 {
+		invalid("faults.message_failure_rate", "The failure rate %v is not between 0 and 1", c.Faults.MessageFailureRate)
+	}
+
+	return errs
+}
+
+// ConfigError is an invalid configuration value. Values read from a file are
+// located by the line and column where they start.
+type ConfigError struct {
+	Path   string
+	Line   int
+	Column int
+	Field  string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.Path != "" {
+		b.WriteString(e.Path + ":")
+		if e.Line > 0 {
+			fmt.Fprintf(&b, "%d:%d:", e.Line, e.Column)
+		}
+		b.WriteString(" ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Err.Error())
+
+	return b.String()
+}
+
+// ReadConfig decodes the configuration file at path on top of c, locating
+// the decoding errors in the file. The values are not validated, as flags may
+// still override them, but the errors of Validate can be located in the file
+// returned. The file is returned unless it could not be read or parsed, in
+// which case the values are not worth validating.
+//
+// The json package keeps decoding the other values after an invalid or
+// unknown one, but only reports the first, so at most one decoding error is
+// returned, and the later ones are found once it is fixed.
+func ReadConfig(path string, c *Config) (*ConfigFile, []*ConfigError) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []*ConfigError{{Err: fmt.Errorf("Failed to read config '%s': %w", path, err)}}
+	}
+
+	file := &ConfigFile{path: path, data: data}
+	err = file.index()
+	if err != nil {
+		return nil, []*ConfigError{file.locate(err)}
+	}
+
+	err = file.decode(c)
+	if err != nil {
+		configErr := file.locate(err)
+		file.undecoded = configErr.Field
+		return file, []*ConfigError{configErr}
+	}
+
+	return file, nil
+}
+
+// Locate sets the line and column of the validation errors of values read
+// from the file, and returns them. The values of the flags set in flags do
+// not come from the file, so their errors are left as is. The value that
+// failed to decode was left at its default, so its errors are left out.
+// Locate returns errs as is on a nil file.
+func (f *ConfigFile) Locate(errs []*ConfigError, flags *flag.FlagSet) []*ConfigError {
+	if f == nil {
+		return errs
+	}
+
+	var overridden []string
+	flags.Visit(func(fl *flag.Flag) {
+		if field, ok := flagFields[fl.Name]; ok {
+			overridden = append(overridden, field)
+		}
+	})
+
+	var located []*ConfigError
+	for _, err := range errs {
+		fromFlag := slices.ContainsFunc(overridden, func(field string) bool {
+			return within(err.Field, field)
+		})
+		if !fromFlag && f.undecoded != "" && within(err.Field, f.undecoded) {
+			continue
+		}
+		if !fromFlag {
+			f.place(err)
+		}
+		located = append(located, err)
+	}
+
+	return located
+}
+
+// within reports whether field is parent or nested in it.
+func within(field, parent string) bool {
+	return field == parent || strings.HasPrefix(field, parent+".") || strings.HasPrefix(field, parent+"[")
+}
+
+// ConfigFile locates the values of a configuration file by their field path,
+// such as "webhooks[1].url".
+type ConfigFile struct {
+	path    string
+	data    []byte
+	offsets map[string]int64
+
+	// undecoded is the field that failed to decode, if any.
+	undecoded string
+}
+
+// index records the offset of every value of the file, failing on syntax
+// errors.
+func (f *ConfigFile) index() error {
+	// The tokenizer reports syntax errors late, so the syntax is checked
+	// beforehand.
+	var value any
+	if err := json.Unmarshal(f.data, &value); err != nil {
+		return err
+	}
+
+	f.offsets = map[string]int64{}
+	dec := json.NewDecoder(bytes.NewReader(f.data))
+
+	var walk func(field string) error
+	walk = func(field string) error {
+		// The offset is after the previous token, so the separators before
+		// the value are skipped.
+		offset := dec.InputOffset()
+		for offset < int64(len(f.data)) && strings.IndexByte(" \t\r\n:,", f.data[offset]) >= 0 {
+			offset++
+		}
+
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		f.offsets[field] = offset
+
+		switch token {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+
+				child := key.(string)
+				if field != "" {
+					child = field + "." + child
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", field, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+		}
+
+		return err
+	}
+
+	err := walk("")
+	if err == nil && dec.More() {
+		err = errors.New("Unexpected data after the configuration")
+	}
+	return err
+}
+
+func (f *ConfigFile) decode(c *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(f.data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// locate converts an error of index or decode into a ConfigError.
+func (f *ConfigFile) locate(err error) *ConfigError {
+	configErr := &ConfigError{Path: f.path, Err: err}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// The offset is after the invalid character.
+		configErr.Line, configErr.Column = f.position(max(syntaxErr.Offset-1, 0))
+	case errors.As(err, &typeErr):
+		configErr.Err = fmt.Errorf("Invalid value %s, expected %s", typeErr.Value, typeName(typeErr.Type))
+		if typeErr.Field != "" {
+			configErr.Field = f.lookup(typeErr.Field, typeErr.Offset)
+		} else {
+			configErr.Field = f.find(typeErr.Value)
+		}
+		f.place(configErr)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		configErr.Err = fmt.Errorf("Unknown field '%s'", name)
+		configErr.Field = f.lookup(name, 0)
+		f.place(configErr)
+	}
+
+	return configErr
+}
+
+// lookup returns the indexed field matching a field path of the json
+// package, which has no array indexes and only names the last field of
+// unknown fields. The json package reports the offset after some invalid
+// values, in which case the last match before it is returned, and the first
+// match otherwise.
+func (f *ConfigFile) lookup(field string, before int64) string {
+	best := ""
+	bestOffset := int64(-1)
+	for indexed, offset := range f.offsets {
+		plain := stripIndexes(indexed)
+		if plain != field && !strings.HasSuffix(plain, "."+field) {
+			continue
+		}
+
+		switch {
+		case before > 0 && offset < before && offset > bestOffset:
+			best, bestOffset = indexed, offset
+		case before <= 0 && (bestOffset < 0 || offset < bestOffset):
+			best, bestOffset = indexed, offset
+		}
+	}
+
+	if best == "" {
+		return field
+	}
+	return best
+}
+
+// find returns the first indexed field with the given raw value, for the
+// errors of Duration, which the json package does not locate.
+func (f *ConfigFile) find(value string) string {
+	best := ""
+	bestOffset := int64(-1)
+	for indexed, offset := range f.offsets {
+		if bytes.HasPrefix(f.data[offset:], []byte(value)) && (bestOffset < 0 || offset < bestOffset) {
+			best, bestOffset = indexed, offset
+		}
+	}
+
+	return best
+}
+
+func stripIndexes(field string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range field {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+// place sets the path, line and column of err from its field. Fields that are
+// not in the file, such as missing values, are placed at their closest
+// parent.
+func (f *ConfigFile) place(err *ConfigError) {
+	err.Path = f.path
+
+	field := err.Field
+	for {
+		if offset, ok := f.offsets[field]; ok {
+			err.Line, err.Column = f.position(offset)
+			return
+		}
+
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			field = ""
+		} else {
+			field = field[:i]
+		}
+	}
+}
+
+func (f *ConfigFile) position(offset int64) (line, column int) {
+	offset = min(offset, int64(len(f.data)))
+	before := f.data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+func typeName(t reflect.Type) string {
+	if t == reflect.TypeFor[Duration]() {
+		return "a duration such as \"5m\""
+	}
+	return t.String()
+}
+
+// Duration is a time.Duration written as a string such as "5m" in
+// configuration files and flags.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) != nil || d.Set(s) != nil {
+		return &json.UnmarshalTypeError{Value: string(data), Type: reflect.TypeFor[Duration]()}
+	}
+
+	return nil
+}
+
+// webhooksFlag parses the -webhooks flag, replacing the configured webhooks.
+type webhooksFlag struct {
+	webhooks *[]*WebhookConfig
+}
+
+func (f webhooksFlag) String() string {
+	return ""
+}
+
+func (f webhooksFlag) Set(value string) error {
+	var webhooks []*WebhookConfig
+	for _, spec := range strings.Split(value, ",") {
+		// Numbers have no colons, so the url starts after the first one.
+		user, rawUrl, found := strings.Cut(spec, ":")
+		if !found || user == "" {
+			return fmt.Errorf("Failed to parse webhook '%s', expected '<user>:<url>'", spec)
+		}
+		if !strings.Contains(rawUrl, "://") {
+			rawUrl = "http://" + rawUrl
+		}
+
+		webhooks = append(webhooks, &WebhookConfig{User: user, URL: rawUrl})
+	}
+
+	*f.webhooks = webhooks
+	return nil
+}
+
+// tokensFlag parses the -tokens flag, replacing the configured tokens.
+type tokensFlag struct {
+	tokens *[]*core.AccessToken
+}
+
+func (f tokensFlag) String() string {
+	return ""
+}
+
+func (f tokensFlag) Set(value string) error {
+	var tokens []*core.AccessToken
+	for _, spec := range strings.Split(value, ",") {
+		user, token, found := strings.Cut(spec, "=")
+		if !found {
+			return fmt.Errorf("Failed to parse token '%s', expected '<user>=<token>'", spec)
+		}
+
+		tokens = append(tokens, &core.AccessToken{Number: user, Token: token})
+	}
+
+	*f.tokens = tokens
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type ReadConfigTest struct {
+	Data   string
+	Errors []string
+}
+
+func TestReadConfig(t *testing.T) {
+	tests := []ReadConfigTest{
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "webhooks": [{"user": "+00", "url": "http://localhost:9000"}],
+  "faults": {"delay": "1s", "failure_rate": 0.5}
+}`,
+		},
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "user": "+00",
+}`,
+			Errors: []string{"config.json:4:1: invalid character '}' looking for beginning of object key string"},
+		},
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "webhooks": [
+    {"user": "+00", "url": "http://localhost:9000", "secret": "x"}
+  ]
+}`,
+			Errors: []string{"config.json:4:63: webhooks[0].secret: Unknown field 'secret'"},
+		},
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "webhook_retry": {
+    "max_age": "forever"
+  }
+}`,
+			Errors: []string{`config.json:4:16: webhook_retry.max_age: Invalid value "forever", expected a duration such as "5m"`},
+		},
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "webhooks": [
+    {"user": "+00", "url": "http://localhost:9000"},
+    {"user": "+11", "url": "localhost:9001"}
+  ],
+  "faults": {"failure_rate": 2}
+}`,
+			Errors: []string{
+				"config.json:5:28: webhooks[1].url: Invalid url 'localhost:9001': the scheme must be http or https",
+				"config.json:7:30: faults.failure_rate: The failure rate 2 is not between 0 and 1",
+			},
+		},
+		{
+			Data:   `{"users": ["+11"]}`,
+			Errors: []string{"config.json:1:1: snapshot: Missing snapshot path"},
+		},
+		// The other values are still validated after a decoding error,
+		// except the one that failed to decode.
+		{
+			Data: `{
+  "snapshot": 5,
+  "webhook_queue": 0
+}`,
+			Errors: []string{
+				"config.json:2:15: snapshot: Invalid value number, expected string",
+				"config.json:3:20: webhook_queue: The webhook queue size must be positive",
+			},
+		},
+		// Only the first decoding error is reported.
+		{
+			Data: `{
+  "snapshot": "state.json",
+  "webhook_queue": "ten",
+  "webhook_timeout": "soon"
+}`,
+			Errors: []string{"config.json:3:20: webhook_queue: Invalid value string, expected int"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+			// Arrange
+			path := filepath.Join(t.TempDir(), "config.json")
+			os.WriteFile(path, []byte(test.Data), 0644)
+			config := DefaultConfig()
+
+			// Act
+			file, errs := ReadConfig(path, &config)
+			if file != nil {
+				errs = append(errs, file.Locate(config.Validate(), flag.NewFlagSet("chatsim", flag.ContinueOnError))...)
+			}
+
+			// Assert
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error()[len(filepath.Dir(path))+1:])
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.Errors) {
+				t.Errorf("Expected errors %q, got %q", test.Errors, got)
+			}
+		})
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+  "snapshot": "state.json",
+  "api_addr": ":9000",
+  "webhook_timeout": "1s",
+  "webhooks": [{"user": "+00", "url": "http://localhost:9000"}]
+}`), 0644)
+
+	config := DefaultConfig()
+	flags := flag.NewFlagSet("chatsim", flag.ContinueOnError)
+	config.Flags(flags)
+	file, errs := ReadConfig(path, &config)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	err := flags.Parse([]string{"-webhook-timeout", "2s", "-webhooks", "+11:localhost:9001,+22:https://example.com/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs = file.Locate(config.Validate(), flags)
+	if len(errs) > 0 {
+		t.Errorf("Expected the configuration to be valid, got %v", errs)
+	}
+
+	if config.APIAddr != ":9000" || config.Snapshot != "state.json" {
+		t.Errorf("Expected the file values to be kept, got '%s' and '%s'", config.APIAddr, config.Snapshot)
+	}
+	if time.Duration(config.WebhookTimeout) != 2*time.Second {
+		t.Errorf("Expected the flag to override the webhook timeout, got %v", config.WebhookTimeout)
+	}
+	if len(config.Webhooks) != 2 || config.Webhooks[0].User != "+11" || config.Webhooks[0].URL != "http://localhost:9001" || config.Webhooks[1].URL != "https://example.com/hook" {
+		t.Errorf("Expected the flag to replace the webhooks, got %+v", config.Webhooks)
+	}
+}
+
+type ConfigOverrideTest struct {
+	Data   string
+	Args   []string
+	Errors []string
+}
+
+func TestConfigOverride(t *testing.T) {
+	tests := []ConfigOverrideTest{
+		// Values missing from the file can be given with flags.
+		{Data: `{"user": "+00"}`, Args: []string{"-snapshot", "state.json"}},
+		{Data: `{"user": "+00"}`, Errors: []string{"config.json:1:1: snapshot: Missing snapshot path"}},
+		// Errors of values given with flags are not located in the file.
+		{
+			Data:   `{"snapshot": "state.json",` + "\n" + `"webhook_queue": 10}`,
+			Args:   []string{"-webhook-queue", "0"},
+			Errors: []string{"webhook_queue: The webhook queue size must be positive"},
+		},
+		{
+			Data:   `{"snapshot": "state.json",` + "\n" + `"webhook_queue": 0}`,
+			Errors: []string{"config.json:2:18: webhook_queue: The webhook queue size must be positive"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+			// Arrange
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.json")
+			os.WriteFile(path, []byte(test.Data), 0644)
+			config := DefaultConfig()
+			flags := flag.NewFlagSet("chatsim", flag.ContinueOnError)
+			config.Flags(flags)
+
+			// Act
+			file, errs := ReadConfig(path, &config)
+			if file != nil {
+				if err := flags.Parse(test.Args); err != nil {
+					t.Fatal(err)
+				}
+				errs = append(errs, file.Locate(config.Validate(), flags)...)
+			}
+
+			// Assert
+			var got []string
+			for _, err := range errs {
+				got = append(got, strings.TrimPrefix(err.Error(), dir+string(filepath.Separator)))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.Errors) {
+				t.Errorf("Expected errors %q, got %q", test.Errors, got)
+			}
+		})
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	config := DefaultConfig()
+	if errs := config.ValidateFile(); len(errs) > 0 {
+		t.Errorf("Expected the snapshot path not to be required in files, got %v", errs)
+	}
+	if errs := config.Validate(); len(errs) != 1 || errs[0].Field != "snapshot" {
+		t.Errorf("Expected the snapshot path to be required, got %v", errs)
+	}
+}
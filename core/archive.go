@@ -0,0 +1,389 @@
+package core
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SnapshotFormat is the encoding of a saved snapshot. Besides plain JSON,
+// snapshots can be saved as archives containing a manifest.json file with the
+// snapshot without its chats, a chats/NNNNNN.json file per chat in the format
+// read by LoadChat, and a media/<hash> file per media blob, named after the
+// hex encoding of its SHA-256 hash.
+type SnapshotFormat string
+
+const (
+	FormatJSON  SnapshotFormat = "json"
+	FormatTar   SnapshotFormat = "tar"
+	FormatTarGz SnapshotFormat = "tar.gz"
+	FormatZip   SnapshotFormat = "zip"
+)
+
+var SnapshotFormats = []SnapshotFormat{FormatJSON, FormatTar, FormatTarGz, FormatZip}
+
+const manifestName = "manifest.json"
+
+// FormatOf returns the snapshot format of a path from its extension. Unknown
+// extensions are assumed to be JSON.
+func FormatOf(path string) SnapshotFormat {
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return FormatTar
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(path, ".zip"):
+		return FormatZip
+	default:
+		return FormatJSON
+	}
+}
+
+// WriteSnapshot encodes the snapshot in the given format, including the media
+// blobs when it is an archive. The core must be locked by the caller.
+func (c *Core) WriteSnapshot(w io.Writer, format SnapshotFormat) error {
+	snapshot := c.Snapshot
+	snapshot.Version = SnapshotVersion
+
+	var archive archiveWriter
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snapshot)
+	case FormatTar:
+		archive = &tarWriter{Writer: tar.NewWriter(w)}
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		archive = &tarWriter{Writer: tar.NewWriter(gz), gzip: gz}
+	case FormatZip:
+		archive = &zipWriter{zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("Unknown snapshot format '%s'", format)
+	}
+
+	manifest := snapshot
+	manifest.Chats = nil
+	err := writeJSONEntry(archive, manifestName, manifest)
+	if err != nil {
+		return err
+	}
+
+	for i, chat := range c.Chats {
+		err = writeJSONEntry(archive, fmt.Sprintf("chats/%06d.json", i), chat)
+		if err != nil {
+			return err
+		}
+	}
+
+	written := map[string]bool{}
+	for _, media := range c.Media {
+		name := "media/" + hex.EncodeToString(media.Hash)
+		if written[name] {
+			continue
+		}
+		written[name] = true
+
+		err = c.writeMediaEntry(archive, name, media)
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func writeJSONEntry(archive archiveWriter, name string, val any) error {
+	data, err := json.MarshalIndent(val, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode '%s': %w", name, err)
+	}
+
+	entry, err := archive.Create(name, int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("Failed to write '%s': %w", name, err)
+	}
+
+	_, err = entry.Write(data)
+	if err != nil {
+		return fmt.Errorf("Failed to write '%s': %w", name, err)
+	}
+
+	return nil
+}
+
+// writeMediaEntry copies a blob into the archive. Media whose blob is missing
+// are skipped, so that a single lost blob does not prevent saving.
+func (c *Core) writeMediaEntry(archive archiveWriter, name string, media *Media) error {
+	content, err := c.OpenMedia(media)
+	if err != nil {
+		log.Printf("Skipping media '%s': %v", media.Id, err)
+		return nil
+	}
+	defer content.Close()
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read media '%s': %w", media.Id, err)
+	}
+
+	entry, err := archive.Create(name, size)
+	if err != nil {
+		return fmt.Errorf("Failed to write '%s': %w", name, err)
+	}
+
+	_, err = io.Copy(entry, content)
+	if err != nil {
+		return fmt.Errorf("Failed to write '%s': %w", name, err)
+	}
+
+	return nil
+}
+
+// ReadSnapshot decodes a snapshot in the given format, migrating it from older
+// versions. The media blobs of archives are added to the media store as they
+// are read, but the snapshot is not applied to the core.
+func (c *Core) ReadSnapshot(r io.Reader, format SnapshotFormat) (Snapshot, error) {
+	snapshot, _, err := c.readSnapshot(r, format)
+	return snapshot, err
+}
+
+// readSnapshot is ReadSnapshot, also returning the version the snapshot had.
+func (c *Core) readSnapshot(r io.Reader, format SnapshotFormat) (Snapshot, int, error) {
+	var snapshot Snapshot
+	var data []byte
+
+	var err error
+	switch format {
+	case FormatJSON:
+		data, err = io.ReadAll(r)
+	case FormatTar:
+		err = walkTar(r, c.archiveReader(&data))
+	case FormatTarGz:
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r)
+		if err == nil {
+			err = walkTar(gz, c.archiveReader(&data))
+		}
+	case FormatZip:
+		err = walkZip(r, c.archiveReader(&data))
+	default:
+		err = fmt.Errorf("Unknown snapshot format '%s'", format)
+	}
+	if err != nil {
+		return snapshot, 0, err
+	}
+
+	data, version, err := migrateSnapshot(data)
+	if err != nil {
+		return snapshot, version, err
+	}
+
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return snapshot, version, fmt.Errorf("Failed to decode snapshot: %w", err)
+	}
+
+	return snapshot, version, nil
+}
+
+// archiveReader returns a function that reassembles the JSON encoding of a
+// snapshot from the entries of an archive into data, so that it is migrated
+// like any other. Chats are ordered by their file names, regardless of the
+// order of the entries.
+func (c *Core) archiveReader(data *[]byte) func(name string, r io.Reader) error {
+	var chatNames []string
+	chats := map[string]json.RawMessage{}
+	var manifest map[string]json.RawMessage
+
+	return func(name string, r io.Reader) error {
+		// The final call, once all entries are read.
+		if r == nil {
+			if manifest == nil {
+				return fmt.Errorf("Missing '%s'", manifestName)
+			}
+
+			slices.Sort(chatNames)
+			var ordered []json.RawMessage
+			for _, name := range chatNames {
+				ordered = append(ordered, chats[name])
+			}
+
+			var err error
+			manifest["chats"], err = json.Marshal(ordered)
+			if err == nil {
+				*data, err = json.Marshal(manifest)
+			}
+			return err
+		}
+
+		switch dir, file := path.Split(name); {
+		case name == manifestName:
+			err := json.NewDecoder(r).Decode(&manifest)
+			if err != nil {
+				return fmt.Errorf("Failed to decode '%s': %w", name, err)
+			}
+		case dir == "chats/" && path.Ext(file) == ".json":
+			var chat json.RawMessage
+			err := json.NewDecoder(r).Decode(&chat)
+			if err != nil {
+				return fmt.Errorf("Failed to decode '%s': %w", name, err)
+			}
+			chatNames = append(chatNames, name)
+			chats[name] = chat
+		case dir == "media/":
+			hash, err := hex.DecodeString(file)
+			if err != nil {
+				return fmt.Errorf("Invalid media file name '%s'", name)
+			}
+
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("Failed to read '%s': %w", name, err)
+			}
+
+			sum := sha256.Sum256(data)
+			if !bytes.Equal(sum[:], hash) {
+				return fmt.Errorf("Media file '%s' does not match its hash", name)
+			}
+
+			err = c.MediaStore.Put(hash, data)
+			if err != nil {
+				return fmt.Errorf("Failed to store '%s': %w", name, err)
+			}
+		default:
+			log.Printf("Ignoring unknown snapshot file '%s'", name)
+		}
+
+		return nil
+	}
+}
+
+type archiveWriter interface {
+	// Create adds a file of the given size to the archive, which must be
+	// fully written before the next one is created.
+	Create(name string, size int64) (io.Writer, error)
+	Close() error
+}
+
+type tarWriter struct {
+	*tar.Writer
+	gzip *gzip.Writer
+}
+
+func (w *tarWriter) Create(name string, size int64) (io.Writer, error) {
+	err := w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	})
+	return w.Writer, err
+}
+
+func (w *tarWriter) Close() error {
+	err := w.Writer.Close()
+	if err == nil && w.gzip != nil {
+		err = w.gzip.Close()
+	}
+	return err
+}
+
+type zipWriter struct {
+	*zip.Writer
+}
+
+func (w *zipWriter) Create(name string, size int64) (io.Writer, error) {
+	return w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+}
+
+// walkTar calls fn with each regular file of the archive, and with a nil
+// reader once done.
+func walkTar(r io.Reader, fn func(name string, r io.Reader) error) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read archive: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = fn(header.Name, archive)
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn("", nil)
+}
+
+// walkZip is the zip counterpart of walkTar. Zip files can only be read with
+// random access, so readers other than files are read into memory first.
+func walkZip(r io.Reader, fn func(name string, r io.Reader) error) error {
+	var readerAt io.ReaderAt
+	var size int64
+
+	if file, ok := r.(*os.File); ok {
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("Failed to read archive: %w", err)
+		}
+		readerAt, size = file, info.Size()
+	} else {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("Failed to read archive: %w", err)
+		}
+		readerAt, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	archive, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		return fmt.Errorf("Failed to read archive: %w", err)
+	}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+
+		entry, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("Failed to read '%s': %w", file.Name, err)
+		}
+
+		err = fn(file.Name, entry)
+		entry.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return fn("", nil)
+}
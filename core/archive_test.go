@@ -0,0 +1,65 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func TestSnapshotFormats(t *testing.T) {
+	for _, format := range SnapshotFormats {
+		t.Run(string(format), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := newLargeCore(ctx, 12, 0)
+			c.PhoneNumbers = []*PhoneNumber{{Id: "1055", Number: "+00"}}
+			for i := 0; i < 3; i++ {
+				if _, err := c.AddMedia("+00", "PNG", []byte(fmt.Sprint("image ", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(t.TempDir(), "snapshot."+string(format))
+
+			// Act
+			err := c.SaveSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The blobs of JSON snapshots are shared through the media
+			// store, while archives bring their own.
+			loaded := NewCore(ctx)
+			if format == FormatJSON {
+				loaded.MediaStore = c.MediaStore
+			}
+			err = loaded.LoadSnapshot(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Assert
+			if !reflect.DeepEqual(c.Snapshot, loaded.Snapshot) {
+				t.Errorf("Snapshot mismatch. Expected %s, got %s", spew.Sdump(c.Snapshot), spew.Sdump(loaded.Snapshot))
+			}
+
+			content, err := loaded.OpenMedia(loaded.Media[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer content.Close()
+
+			data, _ := io.ReadAll(content)
+			if string(data) != "image 2" {
+				t.Errorf("Media mismatch. Expected 'image 2', got '%s'", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+// BusinessAccount is a WhatsApp Business Account, grouping the business
+// numbers of a company. Phone numbers refer to their account by id.
+type BusinessAccount struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (c *Core) GetBusinessAccount(id string) *BusinessAccount {
+	for _, account := range c.BusinessAccounts {
+		if account.Id == id {
+			return account
+		}
+	}
+
+	return nil
+}
+
+// AddBusinessAccount adds a business account, replacing the one with the
+// same id.
+func (c *Core) AddBusinessAccount(account *BusinessAccount) {
+	for i, a := range c.BusinessAccounts {
+		if a.Id == account.Id {
+			c.BusinessAccounts[i] = account
+			return
+		}
+	}
+
+	c.BusinessAccounts = append(c.BusinessAccounts, account)
+}
+
+// GetPhoneNumber returns the phone number with the given id or number.
+func (c *Core) GetPhoneNumber(idOrNumber string) *PhoneNumber {
+	for _, phone := range c.PhoneNumbers {
+		if phone.Id == idOrNumber || phone.Number == idOrNumber {
+			return phone
+		}
+	}
+
+	return nil
+}
+
+// AccountPhoneNumbers returns the phone numbers of a business account.
+func (c *Core) AccountPhoneNumbers(accountId string) []*PhoneNumber {
+	var phones []*PhoneNumber
+	for _, phone := range c.PhoneNumbers {
+		if phone.AccountId == accountId {
+			phones = append(phones, phone)
+		}
+	}
+
+	return phones
+}
+
+// BusinessNumbers returns the phone numbers that belong to a business
+// account.
+func (c *Core) BusinessNumbers() []*PhoneNumber {
+	var phones []*PhoneNumber
+	for _, phone := range c.PhoneNumbers {
+		if c.GetBusinessAccount(phone.AccountId) != nil {
+			phones = append(phones, phone)
+		}
+	}
+
+	return phones
+}
+
+// IsBusinessNumber reports whether number is the number of a business
+// account. Without business accounts, any number may act as a business, as
+// in snapshots that predate them.
+func (c *Core) IsBusinessNumber(number string) bool {
+	if len(c.BusinessAccounts) == 0 {
+		return true
+	}
+
+	phone := c.GetPhoneNumber(number)
+	return phone != nil && c.GetBusinessAccount(phone.AccountId) != nil
+}
+
+// Grants reports whether token grants access on behalf of number, either
+// being its own token or a token of its business account.
+func (c *Core) Grants(token *AccessToken, number string) bool {
+	if token.Number != "" && token.Number == number {
+		return true
+	}
+
+	phone := c.GetPhoneNumber(number)
+	return token.AccountId != "" && phone != nil && phone.AccountId == token.AccountId
+}
@@ -3,12 +3,15 @@ package core
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -22,20 +25,103 @@ var (
 	}
 )
 
+const (
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+	StatusFailed    = "failed"
+)
+
+// statusOrder ranks the non-failure statuses so that a message can only move
+// forward in its lifecycle.
+var statusOrder = map[string]int{
+	"":              0,
+	StatusSent:      1,
+	StatusDelivered: 2,
+	StatusRead:      3,
+}
+
 type Snapshot struct {
-	Chats []*Chat  `json:"chats"`
-	Media []*Media `json:"media"`
+	Version      int            `json:"version"`
+	Chats        []*Chat        `json:"chats,omitempty"`
+	Media        []*Media       `json:"media"`
+	PhoneNumbers []*PhoneNumber `json:"phone_numbers,omitempty"`
+	AccessTokens []*AccessToken `json:"access_tokens,omitempty"`
+
+	BusinessAccounts []*BusinessAccount `json:"business_accounts,omitempty"`
 }
 
 type Core struct {
 	sync.RWMutex
 	Snapshot
 
-	ctx context.Context
+	Webhooks   []*Webhook
+	Deliveries []*Delivery
+	MediaStore MediaStore
+
+	// SnapshotPath is the snapshot file the state is loaded from and saved
+	// to. Other snapshots next to it can be switched to with SwitchSnapshot.
+	SnapshotPath string
+
+	// HistorySize is the number of previous snapshots kept when saving.
+	HistorySize int
+
+	// StaticPhoneNumbers, StaticAccessTokens and StaticBusinessAccounts are
+	// configured outside of the snapshots, such as from the command line.
+	// They are added to every snapshot set, replacing the entries with the
+	// same id or token.
+	StaticPhoneNumbers     []*PhoneNumber
+	StaticAccessTokens     []*AccessToken
+	StaticBusinessAccounts []*BusinessAccount
+
+	index   index
+	journal *journal
+	ctx     context.Context
+
+	// snapshotModTime is the modification time of SnapshotPath, in Unix
+	// nanoseconds, when it was last loaded or saved, so that WatchSnapshot
+	// only reloads it when it is modified by someone else. It is atomic as
+	// SaveSnapshot only holds the read lock.
+	snapshotModTime atomic.Int64
+
+	addListener    chan *Listener
+	removeListener chan *Listener
+	events         chan *Event
+	stats          listenerStats
+}
+
+// PhoneNumber maps a Cloud API phone number id to the simulated number it
+// addresses, so clients can use the ids they are configured with in
+// production. Phone numbers of a business account are business numbers,
+// shown to customers by their display name.
+type PhoneNumber struct {
+	Id          string `json:"id"`
+	Number      string `json:"number"`
+	AccountId   string `json:"account_id,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
 
-	addListener    chan chan *Message
-	removeListener chan chan *Message
-	events         chan *Message
+// Name returns the display name of the phone number, or the number itself
+// when it has none.
+func (p *PhoneNumber) Name() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Number
+}
+
+// AccessToken grants API access on behalf of a simulated number until it
+// expires. Tokens of a business account grant access to all of its phone
+// numbers instead. Tokens without an expiry date never expire.
+type AccessToken struct {
+	Token     string     `json:"token"`
+	Number    string     `json:"number,omitempty"`
+	AccountId string     `json:"account_id,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+func (t *AccessToken) Expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
 }
 
 type Chat struct {
@@ -44,14 +130,40 @@ type Chat struct {
 }
 
 type Message struct {
-	From     string           `json:"from"`
-	To       string           `json:"to"`
-	Type     string           `json:"type"`
-	Text     *TextMessage     `json:"text,omitempty"`
-	Image    *ImageMessage    `json:"image,omitempty"`
-	Audio    *AudioMessage    `json:"audio,omitempty"`
-	Document *DocumentMessage `json:"document,omitempty"`
-	Extra    interface{}      `json:"extra,omitempty"`
+	Id        string           `json:"id"`
+	Timestamp int64            `json:"timestamp,string"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Type      string           `json:"type"`
+	Text      *TextMessage     `json:"text,omitempty"`
+	Image     *ImageMessage    `json:"image,omitempty"`
+	Audio     *AudioMessage    `json:"audio,omitempty"`
+	Document  *DocumentMessage `json:"document,omitempty"`
+	Reaction  *ReactionMessage `json:"reaction,omitempty"`
+	Extra     interface{}      `json:"extra,omitempty"`
+	Status    string           `json:"status,omitempty"`
+	Error     *Error           `json:"error,omitempty"`
+}
+
+// Status describes a transition in a message's lifecycle, as sent in the
+// "statuses" field of the Cloud API webhooks.
+type Status struct {
+	Id          string   `json:"id"`
+	Status      string   `json:"status"`
+	Timestamp   int64    `json:"timestamp,string"`
+	RecipientId string   `json:"recipient_id"`
+	Errors      []*Error `json:"errors,omitempty"`
+}
+
+type Error struct {
+	Code      int        `json:"code"`
+	Title     string     `json:"title"`
+	Message   string     `json:"message,omitempty"`
+	ErrorData *ErrorData `json:"error_data,omitempty"`
+}
+
+type ErrorData struct {
+	Details string `json:"details"`
 }
 
 type TextMessage struct {
@@ -65,6 +177,10 @@ type ImageMessage struct {
 
 type AudioMessage struct {
 	MediaId string `json:"id"`
+
+	// Caption is not supported on audio messages, and is only decoded so
+	// that such messages can be rejected.
+	Caption string `json:"caption,omitempty"`
 }
 
 type DocumentMessage struct {
@@ -73,11 +189,21 @@ type DocumentMessage struct {
 	FileName string `json:"filename"`
 }
 
+// ReactionMessage reacts to a previous message of the chat. An empty emoji
+// removes the reaction.
+type ReactionMessage struct {
+	MessageId string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// Media describe a blob of the media store. Data is only set for the media of
+// snapshots that predate the media store and could not be moved into it.
 type Media struct {
 	Id   string `json:"id"`
 	User string `json:"user"`
 	Type string `json:"type"`
-	Data []byte `json:"data"`
+	Size int64  `json:"size"`
+	Data []byte `json:"data,omitempty"`
 	Hash []byte `json:"hash"`
 }
 
@@ -95,136 +221,311 @@ func (c *Chat) Peer(user string) string {
 
 func NewCore(ctx context.Context) *Core {
 	core := new(Core)
-	core.events = make(chan *Message, 10)
-	core.addListener = make(chan chan *Message, 10)
-	core.removeListener = make(chan chan *Message, 10)
+	core.events = make(chan *Event, 10)
+	core.addListener = make(chan *Listener, 10)
+	core.removeListener = make(chan *Listener, 10)
 	core.ctx = ctx
+	core.MediaStore = NewMemoryMediaStore()
+	core.HistorySize = DefaultHistorySize
+	core.reindex()
 
 	go core.notifyListeners()
 
 	return core
 }
 
-func (c *Core) GetOrCreateChat(members [2]string) *Chat {
-out:
-	for _, chat := range c.Chats {
-		for _, member := range members {
-			if !slices.Contains(chat.Members[:], member) {
-				log.Printf("Chat does not cointain members %v: %+v", members, chat)
-				continue out
-			}
+// ResolveNumber returns the simulated number with the given phone number id.
+// Values that are not a known id are assumed to be numbers already.
+func (c *Core) ResolveNumber(idOrNumber string) string {
+	for _, phone := range c.PhoneNumbers {
+		if phone.Id == idOrNumber {
+			return phone.Number
 		}
-		log.Printf("Chat contains members %v: %+v", members, chat)
+	}
+
+	return idOrNumber
+}
+
+// PhoneNumberId returns the phone number id of the given number, or the
+// number itself when it has no configured id.
+func (c *Core) PhoneNumberId(number string) string {
+	for _, phone := range c.PhoneNumbers {
+		if phone.Number == number {
+			return phone.Id
+		}
+	}
+
+	return number
+}
+
+// AddPhoneNumber adds a phone number id, replacing the one with the same id.
+func (c *Core) AddPhoneNumber(phone *PhoneNumber) {
+	for i, p := range c.PhoneNumbers {
+		if p.Id == phone.Id {
+			c.PhoneNumbers[i] = phone
+			return
+		}
+	}
+
+	c.PhoneNumbers = append(c.PhoneNumbers, phone)
+}
+
+// AddAccessToken adds an access token, replacing the one with the same token.
+func (c *Core) AddAccessToken(token *AccessToken) {
+	for i, t := range c.AccessTokens {
+		if t.Token == token.Token {
+			c.AccessTokens[i] = token
+			return
+		}
+	}
+
+	c.AccessTokens = append(c.AccessTokens, token)
+}
+
+func (c *Core) GetAccessToken(token string) *AccessToken {
+	for _, t := range c.AccessTokens {
+		if t.Token == token {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// GetChat returns the chat between members, or nil if there is none.
+func (c *Core) GetChat(members [2]string) *Chat {
+	return c.index.chats[chatKey(members)]
+}
+
+func (c *Core) GetOrCreateChat(members [2]string) *Chat {
+	if chat := c.GetChat(members); chat != nil {
 		return chat
 	}
 
 	chat := &Chat{Members: members}
 	c.Chats = append(c.Chats, chat)
+	c.indexChat(chat)
 	log.Printf("Chat created: %+v", chat)
+	c.publish(&Event{Type: EventChatCreated, Chat: chat})
 
 	return chat
 }
 
 func (c *Core) AddMessage(chat *Chat, msg *Message) {
+	if msg.Id == "" {
+		msg.Id = newMessageId()
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+
 	chat.Messages = append(chat.Messages, msg)
-	c.events <- msg
+	c.indexMessage(chat, msg)
+	c.publish(&Event{Type: EventMessageCreated, Chat: chat, Message: msg})
+
+	if msg.Type == "reaction" && msg.Reaction != nil {
+		c.publish(&Event{
+			Type:    EventReactionAdded,
+			Chat:    chat,
+			Message: msg,
+			Target:  c.GetMessage(msg.Reaction.MessageId),
+		})
+	}
+
+	if msg.Status == "" {
+		c.UpdateStatus(msg, StatusSent, nil)
+	}
 }
 
-func (c *Core) AddMedia(user, typ string, data []byte) string {
-	id := uuid.NewString()
-	hash := sha256.Sum256(data)
+// UpdateStatus moves msg forward in its sent -> delivered -> read lifecycle,
+// or marks it as failed with the given error. Transitions that would move a
+// message backwards, or out of a final state, are rejected.
+func (c *Core) UpdateStatus(msg *Message, status string, err *Error) error {
+	if msg.Status == StatusFailed || msg.Status == StatusRead {
+		return fmt.Errorf("Message '%s' is already %s", msg.Id, msg.Status)
+	}
 
-	m := &Media{
-		Id:   id,
-		User: user,
-		Type: typ,
-		Data: data,
-		Hash: hash[:],
+	switch status {
+	case StatusFailed:
+		if err == nil {
+			return fmt.Errorf("Message '%s' can not fail without an error", msg.Id)
+		}
+	case StatusSent, StatusDelivered, StatusRead:
+		if statusOrder[status] <= statusOrder[msg.Status] {
+			return fmt.Errorf("Message '%s' can not go from %s to %s", msg.Id, msg.Status, status)
+		}
+	default:
+		return fmt.Errorf("Unknown message status '%s'", status)
 	}
-	c.Media = append(c.Media, m)
 
-	return id
+	msg.Status = status
+	msg.Error = err
+
+	st := &Status{
+		Id:          msg.Id,
+		Status:      status,
+		Timestamp:   time.Now().Unix(),
+		RecipientId: msg.To,
+	}
+	if err != nil {
+		st.Errors = []*Error{err}
+	}
+	c.publish(&Event{Type: EventStatusChanged, Chat: c.messageChat(msg), Message: msg, Status: st})
+
+	return nil
 }
 
-func (c *Core) GetMedia(id string) *Media {
-	for _, media := range c.Media {
-		if media.Id == id {
-			return media
+// newMessageId generates an identifier in the style of the Cloud API's
+// "wamid." message ids.
+func newMessageId() string {
+	id := uuid.New()
+	return "wamid." + base64.RawURLEncoding.EncodeToString(id[:])
+}
+
+// MarkRead marks msg as read, along with the earlier messages of its chat
+// from the same sender, like the Cloud API does. Messages go through the
+// delivered status first if they were not delivered yet, and failed messages
+// are left as is.
+func (c *Core) MarkRead(msg *Message) error {
+	if chat := c.messageChat(msg); chat != nil {
+		for _, earlier := range chat.Messages {
+			if earlier == msg {
+				break
+			}
+			if earlier.From != msg.From || earlier.Status == StatusRead || earlier.Status == StatusFailed {
+				continue
+			}
+
+			if err := c.markRead(earlier); err != nil {
+				log.Print(err)
+			}
 		}
 	}
 
-	return nil
+	return c.markRead(msg)
 }
 
-func (c *Core) AddListener() chan *Message {
-	l := make(chan *Message, 10)
-	c.addListener <- l
+func (c *Core) markRead(msg *Message) error {
+	if msg.Status == "" || msg.Status == StatusSent {
+		err := c.UpdateStatus(msg, StatusDelivered, nil)
+		if err != nil {
+			return err
+		}
+	}
 
-	return l
+	return c.UpdateStatus(msg, StatusRead, nil)
 }
 
-func (c *Core) RemoveListener(l chan *Message) {
-	c.removeListener <- l
+func (c *Core) GetMessage(id string) *Message {
+	return c.index.messages[id].msg
 }
 
-func (c *Core) notifyListeners() {
-	listeners := map[chan *Message]bool{}
-	done := c.ctx.Done()
+func (c *Core) messageChat(msg *Message) *Chat {
+	indexed := c.index.messages[msg.Id]
+	if indexed.msg != msg {
+		return nil
+	}
+
+	return indexed.chat
+}
 
-	defer func() {
-		for listener := range listeners {
-			close(listener)
-		}
-	}()
+func (c *Core) AddMedia(user, typ string, data []byte) (string, error) {
+	id := uuid.NewString()
+	hash := sha256.Sum256(data)
 
-	for {
-		select {
-		case msg := <-c.events:
-			for listener := range listeners {
-				listener <- msg
-			}
-		case listener := <-c.addListener:
-			listeners[listener] = true
-		case listener := <-c.removeListener:
-			delete(listeners, listener)
-		case <-done:
-			return
-		}
+	err := c.MediaStore.Put(hash[:], data)
+	if err != nil {
+		return "", fmt.Errorf("Failed to store media: %w", err)
+	}
+
+	m := &Media{
+		Id:   id,
+		User: user,
+		Type: typ,
+		Size: int64(len(data)),
+		Hash: hash[:],
 	}
+	c.Media = append(c.Media, m)
+	c.indexMedia(m)
+	c.publish(&Event{Type: EventMediaAdded, Media: m})
+
+	return id, nil
+}
+
+func (c *Core) GetMedia(id string) *Media {
+	return c.index.media[id]
 }
 
+// SaveSnapshot atomically replaces the snapshot at path, in the format given
+// by its extension, keeping the previous one in the history. The core must
+// be locked by the caller, at least for reading.
 func (c *Core) SaveSnapshot(path string) (err error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	err = c.writeAtomic(path, func(w io.Writer) error {
+		return c.WriteSnapshot(w, FormatOf(path))
+	})
 	if err != nil {
-		return fmt.Errorf("Failed to open snapshot '%s': %w", path, err)
+		return fmt.Errorf("Failed to save snapshot '%s': %w", path, err)
 	}
 
-	enc := json.NewEncoder(file)
-	enc.SetIndent("", "  ")
-	err = enc.Encode(c.Snapshot)
-	if err != nil {
-		return fmt.Errorf("Failed to encode snapshot '%s': %w", err)
+	if path == c.SnapshotPath {
+		if info, err := os.Stat(path); err == nil {
+			c.snapshotModTime.Store(info.ModTime().UnixNano())
+		}
 	}
 
 	return nil
 }
 
+// LoadSnapshot replaces the state of the core with the snapshot at path, in
+// the format given by its extension.
 func (c *Core) LoadSnapshot(path string) (err error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("Failed to open snapshot '%s: %w'", path, err)
 	}
+	defer file.Close()
 
-	var snapshot Snapshot
-	err = json.NewDecoder(file).Decode(&snapshot)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("Failed to open snapshot '%s': %w", path, err)
+	}
+
+	snapshot, err := c.ReadSnapshot(file, FormatOf(path))
 	if err != nil {
 		return fmt.Errorf("Failed to decode snapshot '%s': %w", path, err)
 	}
 
-	c.Snapshot = snapshot
+	if path == c.SnapshotPath {
+		c.snapshotModTime.Store(info.ModTime().UnixNano())
+	}
+
+	c.SetSnapshot(snapshot)
 	return nil
 }
 
+// SetSnapshot replaces the state of the core, notifying the listeners. The
+// snapshot must not be assigned directly, as the indexes would go stale.
+func (c *Core) SetSnapshot(snapshot Snapshot) {
+	c.setSnapshot(snapshot, EventSnapshotLoaded)
+}
+
+func (c *Core) setSnapshot(snapshot Snapshot, typ EventType) {
+	c.Snapshot = snapshot
+	c.Version = SnapshotVersion
+	for _, phone := range c.StaticPhoneNumbers {
+		c.AddPhoneNumber(phone)
+	}
+	for _, token := range c.StaticAccessTokens {
+		c.AddAccessToken(token)
+	}
+	for _, account := range c.StaticBusinessAccounts {
+		c.AddBusinessAccount(account)
+	}
+	c.storeInlineMedia()
+	c.reindex()
+	c.publish(&Event{Type: typ})
+}
+
 func (c *Core) LoadChat(path string) (err error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -238,5 +539,8 @@ func (c *Core) LoadChat(path string) (err error) {
 	}
 
 	c.Chats = append(c.Chats, chat)
+	c.indexChat(chat)
+	c.publish(&Event{Type: EventChatCreated, Chat: chat})
+
 	return nil
 }
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func addMessages(c *Core, n int) {
+	chat := c.GetOrCreateChat([2]string{"+00", "+11"})
+	for i := 0; i < n; i++ {
+		c.AddMessage(chat, &Message{
+			From: "+00",
+			To:   "+11",
+			Type: "text",
+			Text: &TextMessage{Body: fmt.Sprint(i)},
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type OverflowTest struct {
+	Overflow OverflowPolicy
+	Closed   bool
+}
+
+func TestStuckListenerDoesNotBlock(t *testing.T) {
+	tests := []OverflowTest{
+		{Overflow: DropOldest, Closed: false},
+		{Overflow: Disconnect, Closed: true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := NewCore(ctx)
+			stuck := c.AddListener(ListenerOptions{Buffer: 1, Overflow: test.Overflow})
+			waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+			// Act
+			done := make(chan bool)
+			go func() {
+				addMessages(c, 100)
+				close(done)
+			}()
+
+			// Assert
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("AddMessage blocked on a stuck listener")
+			}
+
+			// Each message also emits a sent status, after the chat is
+			// created.
+			waitFor(t, "events", func() bool { return c.ListenerStats().Published == 201 })
+
+			if stuck.Dropped() == 0 || c.ListenerStats().Dropped != stuck.Dropped() {
+				t.Errorf("Dropped events mismatch. Listener dropped %d, stats %+v", stuck.Dropped(), c.ListenerStats())
+			}
+
+			if test.Closed {
+				for range stuck.C {
+				}
+			}
+
+			stats := c.ListenerStats()
+			if test.Closed && (stats.Disconnected != 1 || stats.Listeners != 0) {
+				t.Errorf("Expected slow listener to be disconnected, got %+v", stats)
+			}
+			if !test.Closed && (stats.Disconnected != 0 || len(stuck.C) != 1) {
+				t.Errorf("Expected slow listener to keep its newest event, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestDropOldestKeepsNewestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCore(ctx)
+	l := c.AddListener(ListenerOptions{Buffer: 2, Overflow: DropOldest})
+	waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+	addMessages(c, 10)
+	waitFor(t, "events", func() bool { return c.ListenerStats().Published == 21 })
+
+	var last []*Event
+	for len(l.C) > 0 {
+		last = append(last, <-l.C)
+	}
+
+	if len(last) != 2 || last[0].Type != EventMessageCreated || last[0].Message.Text.Body != "9" || last[1].Type != EventStatusChanged {
+		t.Errorf("Expected the last message and its status, got %+v", last)
+	}
+}
+
+type FilterTest struct {
+	Filter   EventFilter
+	Expected []EventType
+}
+
+func TestListenerFilter(t *testing.T) {
+	tests := []FilterTest{
+		{
+			Filter:   EventFilter{},
+			Expected: []EventType{EventChatCreated, EventMessageCreated, EventStatusChanged, EventMediaAdded, EventChatCreated, EventMessageCreated, EventStatusChanged},
+		},
+		{
+			Filter:   EventFilter{Types: []EventType{EventChatCreated, EventMediaAdded}},
+			Expected: []EventType{EventChatCreated, EventMediaAdded, EventChatCreated},
+		},
+		{
+			Filter:   EventFilter{Users: []string{"+22"}},
+			Expected: []EventType{EventMediaAdded, EventChatCreated, EventMessageCreated, EventStatusChanged},
+		},
+		{
+			Filter:   EventFilter{Types: []EventType{EventMessageCreated}, Users: []string{"+00"}},
+			Expected: []EventType{EventMessageCreated},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := NewCore(ctx)
+			l := c.AddListener(ListenerOptions{Filter: test.Filter})
+			waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+			// Act
+			addMessages(c, 1)
+			c.AddMedia("+22", "PNG", nil)
+			chat := c.GetOrCreateChat([2]string{"+11", "+22"})
+			c.AddMessage(chat, &Message{From: "+22", To: "+11", Type: "text", Text: &TextMessage{Body: "hi"}})
+			waitFor(t, "events", func() bool { return c.ListenerStats().Published == 7 })
+
+			// Assert
+			var types []EventType
+			for len(l.C) > 0 {
+				types = append(types, (<-l.C).Type)
+			}
+
+			if !slices.Equal(types, test.Expected) {
+				t.Errorf("Expected events %v, got %v", test.Expected, types)
+			}
+		})
+	}
+}
+
+func TestChatFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCore(ctx)
+	chat := c.GetOrCreateChat([2]string{"+00", "+11"})
+	waitFor(t, "chat", func() bool { return c.ListenerStats().Published == 1 })
+
+	l := c.AddListener(ListenerOptions{Filter: EventFilter{Chat: chat}})
+	waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+	addMessages(c, 1)
+	other := c.GetOrCreateChat([2]string{"+00", "+22"})
+	c.AddMessage(other, &Message{From: "+00", To: "+22", Type: "text", Text: &TextMessage{Body: "hi"}})
+	c.AddMedia("+00", "PNG", nil)
+	c.publish(&Event{Type: EventSnapshotLoaded})
+	waitFor(t, "events", func() bool { return c.ListenerStats().Published == 8 })
+
+	var types []EventType
+	for len(l.C) > 0 {
+		types = append(types, (<-l.C).Type)
+	}
+
+	expected := []EventType{EventMessageCreated, EventStatusChanged, EventSnapshotLoaded}
+	if !slices.Equal(types, expected) {
+		t.Errorf("Expected events %v, got %v", expected, types)
+	}
+}
+
+type StatusTest struct {
+	// Statuses are applied in order to a new message, and Rejected are
+	// the indexes of those that must be refused.
+	Statuses []string
+	Rejected []int
+	Status   string
+}
+
+func TestUpdateStatus(t *testing.T) {
+	tests := []StatusTest{
+		{Statuses: []string{StatusDelivered, StatusRead}, Status: StatusRead},
+		{Statuses: []string{StatusRead}, Status: StatusRead},
+		{Statuses: []string{StatusRead, StatusDelivered}, Rejected: []int{1}, Status: StatusRead},
+		{Statuses: []string{StatusDelivered, StatusSent}, Rejected: []int{1}, Status: StatusDelivered},
+		{Statuses: []string{StatusDelivered, StatusDelivered}, Rejected: []int{1}, Status: StatusDelivered},
+		{Statuses: []string{StatusFailed}, Status: StatusFailed},
+		{Statuses: []string{StatusDelivered, StatusFailed}, Status: StatusFailed},
+		{Statuses: []string{StatusFailed, StatusDelivered}, Rejected: []int{1}, Status: StatusFailed},
+		{Statuses: []string{StatusRead, StatusFailed}, Rejected: []int{1}, Status: StatusRead},
+		{Statuses: []string{"unknown"}, Rejected: []int{0}, Status: StatusSent},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := NewCore(ctx)
+			addMessages(c, 1)
+			msg := c.Chats[0].Messages[0]
+
+			// Act
+			for i, status := range test.Statuses {
+				var failure *Error
+				if status == StatusFailed {
+					failure = NewError(ErrUndeliverable, "Failed")
+				}
+
+				err := c.UpdateStatus(msg, status, failure)
+				if rejected := slices.Contains(test.Rejected, i); rejected != (err != nil) {
+					t.Errorf("Expected %s to be rejected: %v, got %v", status, rejected, err)
+				}
+			}
+
+			// Assert
+			if msg.Status != test.Status {
+				t.Errorf("Expected the message to be %s, got %s", test.Status, msg.Status)
+			}
+			if (msg.Error != nil) != (test.Status == StatusFailed) {
+				t.Errorf("Unexpected error %+v for status %s", msg.Error, msg.Status)
+			}
+		})
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+
+	// Arrange
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCore(ctx)
+	chat := c.GetOrCreateChat([2]string{"+00", "+11"})
+	inbound := func(body string) *Message {
+		msg := &Message{From: "+11", To: "+00", Type: "text", Text: &TextMessage{Body: body}}
+		c.AddMessage(chat, msg)
+		return msg
+	}
+
+	first := inbound("first")
+	reply := &Message{From: "+00", To: "+11", Type: "text", Text: &TextMessage{Body: "reply"}}
+	c.AddMessage(chat, reply)
+	failed := inbound("failed")
+	c.UpdateStatus(failed, StatusFailed, NewError(ErrUndeliverable, "Failed"))
+	delivered := inbound("delivered")
+	c.UpdateStatus(delivered, StatusDelivered, nil)
+	marked := inbound("marked")
+	later := inbound("later")
+
+	c.Flush()
+	l := c.AddListener(ListenerOptions{
+		Buffer: 100,
+		Filter: EventFilter{Types: []EventType{EventStatusChanged}},
+	})
+	waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+	// Act
+	if err := c.MarkRead(marked); err != nil {
+		t.Fatal(err)
+	}
+	c.Flush()
+
+	// Assert
+	expected := map[*Message]string{
+		first:     StatusRead,
+		reply:     StatusSent,
+		failed:    StatusFailed,
+		delivered: StatusRead,
+		marked:    StatusRead,
+		later:     StatusSent,
+	}
+	for msg, status := range expected {
+		if msg.Status != status {
+			t.Errorf("Expected message '%s' to be %s, got %s", msg.Text.Body, status, msg.Status)
+		}
+	}
+
+	var events []string
+	for len(l.C) > 0 {
+		event := <-l.C
+		events = append(events, event.Message.Text.Body+":"+event.Status.Status)
+	}
+	expectedEvents := []string{
+		"first:delivered", "first:read",
+		"delivered:read",
+		"marked:delivered", "marked:read",
+	}
+	if !slices.Equal(events, expectedEvents) {
+		t.Errorf("Expected status events %v, got %v", expectedEvents, events)
+	}
+}
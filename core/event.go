@@ -0,0 +1,107 @@
+package core
+
+import "slices"
+
+type EventType string
+
+const (
+	EventMessageCreated    EventType = "message_created"
+	EventStatusChanged     EventType = "status_changed"
+	EventReactionAdded     EventType = "reaction_added"
+	EventChatCreated       EventType = "chat_created"
+	EventMediaAdded        EventType = "media_added"
+	EventSnapshotLoaded    EventType = "snapshot_loaded"
+	EventReset             EventType = "reset"
+	EventWebhookRegistered EventType = "webhook_registered"
+	EventWebhookRemoved    EventType = "webhook_removed"
+	EventDeliveryUpdated   EventType = "delivery_updated"
+)
+
+// Event is broadcast to listeners whenever the state of the core changes.
+// Only the fields relevant to the event type are set:
+//
+//   - EventMessageCreated: Chat and Message.
+//   - EventStatusChanged: Chat, Message and Status.
+//   - EventReactionAdded: Chat, Message (the reaction) and Target (the
+//     message reacted to).
+//   - EventChatCreated: Chat.
+//   - EventMediaAdded: Media.
+//   - EventSnapshotLoaded, EventReset: nothing, listeners should reload their
+//     state, as every chat, message and media may have been replaced.
+//   - EventWebhookRegistered, EventWebhookRemoved: Webhook.
+//   - EventDeliveryUpdated: Delivery, either queued or attempted.
+//
+// Reactions are messages as well, so they are also broadcast as
+// EventMessageCreated.
+type Event struct {
+	Type     EventType
+	Chat     *Chat
+	Message  *Message
+	Target   *Message
+	Status   *Status
+	Media    *Media
+	Webhook  *Webhook
+	Delivery *Delivery
+
+	// flushed marks the events sent by Flush, which are not broadcast.
+	flushed chan struct{}
+}
+
+// Users returns the numbers involved in the event.
+func (e *Event) Users() []string {
+	switch {
+	case e.Chat != nil:
+		return e.Chat.Members[:]
+	case e.Message != nil:
+		return []string{e.Message.From, e.Message.To}
+	case e.Media != nil:
+		return []string{e.Media.User}
+	case e.Webhook != nil:
+		return []string{e.Webhook.User}
+	case e.Delivery != nil:
+		return []string{e.Delivery.Webhook.User}
+	}
+
+	return nil
+}
+
+// Global reports whether the event concerns the whole core rather than a
+// user or chat, in which case it passes every user and chat filter.
+func (e *Event) Global() bool {
+	return e.Type == EventSnapshotLoaded || e.Type == EventReset
+}
+
+// EventFilter selects the events delivered to a listener. Empty fields match
+// every event.
+type EventFilter struct {
+	Types []EventType
+
+	// Users matches the events involving any of the numbers.
+	Users []string
+
+	// Chat matches the events of a single chat, and excludes the events
+	// that are not about a chat at all.
+	Chat *Chat
+}
+
+func (f *EventFilter) Matches(event *Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, event.Type) {
+		return false
+	}
+
+	if event.Global() {
+		return true
+	}
+
+	if f.Chat != nil && event.Chat != f.Chat {
+		return false
+	}
+
+	if len(f.Users) > 0 && !slices.ContainsFunc(event.Users(), func(user string) bool {
+		return slices.Contains(f.Users, user)
+	}) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultHistorySize is the number of previous snapshots kept by the cores
+// created with NewCore.
+const DefaultHistorySize = 10
+
+// historyTimeFormat sorts lexicographically, so history files sort by age.
+const historyTimeFormat = "20060102T150405.000Z"
+
+// maxHistoryCollisions bounds the versions kept with the same modification
+// time.
+const maxHistoryCollisions = 999
+
+// SnapshotFile is a snapshot found on disk, either next to the current one or
+// in its history.
+type SnapshotFile struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// SnapshotBase returns a snapshot path without its extension. Files related
+// to the snapshot, such as its media directory, are named after it.
+func SnapshotBase(path string) string {
+	base := strings.TrimSuffix(path, ".gz")
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// HistoryDir returns the directory keeping the previous versions of the
+// snapshot at path.
+func HistoryDir(path string) string {
+	return SnapshotBase(path) + ".history"
+}
+
+// writeAtomic replaces the file at path with the output of write, such that
+// a crash leaves either the previous or the new file behind, never a partial
+// one. The previous file is kept in the history first.
+func (c *Core) writeAtomic(path string, write func(w io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	c.keepHistory(path)
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is synced. Some
+	// platforms can not sync directories, which is not worth failing for.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// keepHistory links the current snapshot at path into the history, named
+// after the time it was saved, and discards the versions beyond
+// HistorySize. Versions saved within the resolution of the modification time
+// are told apart by a counter, which sorts after the first name. Failing to
+// keep history does not prevent saving.
+func (c *Core) keepHistory(path string) {
+	if c.HistorySize <= 0 {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	dir := HistoryDir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Printf("Failed to create snapshot history '%s': %v", dir, err)
+		return
+	}
+
+	ext := strings.TrimPrefix(path, SnapshotBase(path))
+	stamp := filepath.Base(SnapshotBase(path)) + "-" + info.ModTime().UTC().Format(historyTimeFormat)
+	for i := 0; ; i++ {
+		name := stamp + ext
+		if i > 0 {
+			name = fmt.Sprintf("%s_%03d%s", stamp, i, ext)
+		}
+
+		err = os.Link(path, filepath.Join(dir, name))
+		if err != nil && !os.IsExist(err) {
+			err = copyFile(path, filepath.Join(dir, name))
+		}
+		if !os.IsExist(err) || i == maxHistoryCollisions {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to keep snapshot '%s' in history: %v", path, err)
+		return
+	}
+
+	entries, err := c.SnapshotHistory(path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, entry := range entries[min(len(entries), c.HistorySize):] {
+		err = os.Remove(filepath.Join(dir, entry.Name))
+		if err != nil {
+			log.Printf("Failed to discard snapshot '%s' from history: %v", entry.Name, err)
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+
+	return err
+}
+
+// SnapshotHistory lists the previous versions of the snapshot at path, from
+// newest to oldest.
+func (c *Core) SnapshotHistory(path string) ([]*SnapshotFile, error) {
+	dir := HistoryDir(path)
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list snapshot history '%s': %w", dir, err)
+	}
+
+	slices.Reverse(files)
+	return files, nil
+}
+
+// listSnapshotFiles lists the snapshots of a directory sorted by name,
+// skipping hidden files such as the temporary files of writeAtomic. A missing
+// directory has no snapshots.
+func listSnapshotFiles(dir string) ([]*SnapshotFile, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*SnapshotFile
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || !isSnapshotName(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		files = append(files, &SnapshotFile{
+			Name: entry.Name(),
+			Time: info.ModTime(),
+			Size: info.Size(),
+		})
+	}
+
+	return files, nil
+}
+
+// isSnapshotName reports whether a file name has the extension of one of the
+// SnapshotFormats.
+func isSnapshotName(name string) bool {
+	for _, ext := range []string{".json", ".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RestoreSnapshot replaces the state of the core with a previous version of
+// the snapshot at path, as listed by SnapshotHistory. The snapshot at path is
+// not modified until the core is saved. The core must be locked by the
+// caller.
+func (c *Core) RestoreSnapshot(path, name string) error {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid snapshot name '%s'", name)
+	}
+
+	return c.LoadSnapshot(filepath.Join(HistoryDir(path), name))
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot.json")
+
+	// Each save has one chat less, so that a non atomic save would leave
+	// trailing garbage behind.
+	c := NewCore(ctx)
+	c.HistorySize = 3
+	for i := 5; i >= 0; i-- {
+		c.SetSnapshot(newLargeCore(ctx, i, 0).Snapshot)
+		if err := c.SaveSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected the snapshot and its history only, got %v", files)
+	}
+
+	entries, err := c.SnapshotHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 previous snapshots, got %d", len(entries))
+	}
+
+	// The newest previous snapshot is the one saved with 1 chat.
+	for i, entry := range entries {
+		err = c.RestoreSnapshot(path, entry.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Chats) != i+1 {
+			t.Errorf("Expected %s to have %d chats, got %d", entry.Name, i+1, len(c.Chats))
+		}
+	}
+
+	err = c.LoadSnapshot(path)
+	if err != nil || len(c.Chats) != 0 {
+		t.Errorf("Expected the last saved snapshot, got %d chats (%v)", len(c.Chats), err)
+	}
+
+	for _, name := range []string{"../snapshot.json", ".hidden", "missing.json"} {
+		if err := c.RestoreSnapshot(path, name); err == nil {
+			t.Errorf("Expected restoring '%s' to fail", name)
+		}
+	}
+}
+
+// Saves within the resolution of the modification time must not overwrite
+// each other in the history.
+func TestSnapshotHistoryCollisions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	c := NewCore(ctx)
+	for i := 0; i < 5; i++ {
+		c.SetSnapshot(newLargeCore(ctx, i, 0).Snapshot)
+		if err := c.SaveSnapshot(path); err != nil {
+			t.Fatal(err)
+		}
+		// The same modification time for every save, as on a filesystem
+		// with coarse timestamps.
+		os.Chtimes(path, time.Unix(0, 0), time.Unix(0, 0))
+	}
+
+	entries, err := c.SnapshotHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 previous snapshots, got %d", len(entries))
+	}
+
+	// The newest previous snapshot is the one saved with 3 chats.
+	for i, entry := range entries {
+		if err := c.RestoreSnapshot(path, entry.Name); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Chats) != 3-i {
+			t.Errorf("Expected %s to have %d chats, got %d", entry.Name, 3-i, len(c.Chats))
+		}
+	}
+}
+
+func TestSnapshotBase(t *testing.T) {
+	for path, base := range map[string]string{
+		"state.json":         "state",
+		"dir/state.tar.gz":   "dir/state",
+		"state.tgz":          "state",
+		"state.v2.zip":       "state.v2",
+		"no_extension":       "no_extension",
+		"dir.d/state.json":   "dir.d/state",
+		"dir.d/no_extension": "dir.d/no_extension",
+	} {
+		if SnapshotBase(path) != base {
+			t.Errorf("Expected base of '%s' to be '%s', got '%s'", path, base, SnapshotBase(path))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package core
+
+// index speeds up the lookups of chats, media and messages, which are kept
+// in slices so that snapshots preserve their order. It must be kept in sync
+// with the snapshot by every method that adds to it.
+type index struct {
+	chats    map[[2]string]*Chat
+	media    map[string]*Media
+	messages map[string]indexedMessage
+}
+
+type indexedMessage struct {
+	msg  *Message
+	chat *Chat
+}
+
+// chatKey identifies a chat regardless of the order of its members.
+func chatKey(members [2]string) [2]string {
+	if members[0] > members[1] {
+		members[0], members[1] = members[1], members[0]
+	}
+	return members
+}
+
+// reindex rebuilds the indexes from the snapshot. When a snapshot repeats an
+// id, the first occurrence wins, as it did with linear scans.
+func (c *Core) reindex() {
+	c.index = index{
+		chats:    make(map[[2]string]*Chat, len(c.Chats)),
+		media:    make(map[string]*Media, len(c.Media)),
+		messages: make(map[string]indexedMessage),
+	}
+
+	for _, chat := range c.Chats {
+		c.indexChat(chat)
+	}
+	for _, media := range c.Media {
+		c.indexMedia(media)
+	}
+}
+
+func (c *Core) indexChat(chat *Chat) {
+	key := chatKey(chat.Members)
+	if _, found := c.index.chats[key]; !found {
+		c.index.chats[key] = chat
+	}
+
+	for _, msg := range chat.Messages {
+		c.indexMessage(chat, msg)
+	}
+}
+
+func (c *Core) indexMessage(chat *Chat, msg *Message) {
+	if _, found := c.index.messages[msg.Id]; !found {
+		c.index.messages[msg.Id] = indexedMessage{msg: msg, chat: chat}
+	}
+}
+
+func (c *Core) indexMedia(media *Media) {
+	if _, found := c.index.media[media.Id]; !found {
+		c.index.media[media.Id] = media
+	}
+}
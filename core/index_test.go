@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newLargeCore returns a core with a snapshot of the given number of chats,
+// with a message each, and media.
+func newLargeCore(ctx context.Context, chats, media int) *Core {
+	var snapshot Snapshot
+	for i := 0; i < chats; i++ {
+		snapshot.Chats = append(snapshot.Chats, &Chat{
+			Members:  [2]string{"+00", fmt.Sprintf("+%d", i)},
+			Messages: []*Message{{Id: fmt.Sprintf("wamid.%d", i), From: fmt.Sprintf("+%d", i), To: "+00", Type: "text"}},
+		})
+	}
+	for i := 0; i < media; i++ {
+		snapshot.Media = append(snapshot.Media, &Media{Id: fmt.Sprintf("media%d", i), User: "+00", Type: "PNG"})
+	}
+
+	c := NewCore(ctx)
+	c.SetSnapshot(snapshot)
+	return c
+}
+
+func TestIndexesRebuiltOnLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	chatPath := filepath.Join(dir, "chat.json")
+
+	err := newLargeCore(ctx, 10, 10).SaveSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chat, _ := json.Marshal(&Chat{
+		Members:  [2]string{"+11", "+22"},
+		Messages: []*Message{{Id: "wamid.loaded", From: "+11", To: "+22", Type: "text"}},
+	})
+	err = os.WriteFile(chatPath, chat, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCore(ctx)
+	if err := c.LoadSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadChat(chatPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if chat := c.GetOrCreateChat([2]string{"+5", "+00"}); chat != c.Chats[5] {
+		t.Errorf("Expected existing chat %+v, got %+v", c.Chats[5], chat)
+	}
+	if chat := c.GetOrCreateChat([2]string{"+22", "+11"}); chat != c.Chats[10] {
+		t.Errorf("Expected loaded chat %+v, got %+v", c.Chats[10], chat)
+	}
+	if len(c.Chats) != 11 {
+		t.Errorf("Expected no chat to be created, got %d chats", len(c.Chats))
+	}
+	if msg := c.GetMessage("wamid.loaded"); msg != c.Chats[10].Messages[0] {
+		t.Errorf("Expected loaded message, got %+v", msg)
+	}
+	if media := c.GetMedia("media3"); media != c.Media[3] {
+		t.Errorf("Expected media %+v, got %+v", c.Media[3], media)
+	}
+	if media := c.GetMedia("missing"); media != nil {
+		t.Errorf("Expected no media, got %+v", media)
+	}
+}
+
+var benchmarkSizes = []int{100, 10000}
+
+func BenchmarkGetOrCreateChat(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d chats", size), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := newLargeCore(ctx, size, 0)
+			members := [2]string{fmt.Sprintf("+%d", size-1), "+00"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.GetOrCreateChat(members)
+			}
+		})
+	}
+}
+
+func BenchmarkGetMedia(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d media", size), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := newLargeCore(ctx, 0, size)
+			id := fmt.Sprintf("media%d", size-1)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.GetMedia(id)
+			}
+		})
+	}
+}
+
+func BenchmarkGetMessage(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%d messages", size), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := newLargeCore(ctx, size, 0)
+			id := fmt.Sprintf("wamid.%d", size-1)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.GetMessage(id)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+)
+
+// journal is an append-only log of the mutations of the core since the
+// snapshot was last saved, one JSON entry per line. Entries are written as
+// the mutations happen, so they survive the process dying, and replayed on
+// top of the snapshot when the journal is opened again.
+//
+// Once the state is replaced, by a reset or by loading another snapshot, the
+// journal starts with a baseline entry holding the new state instead, so
+// that the snapshot file is only replaced when saved explicitly.
+//
+// Webhooks and their deliveries are not part of the snapshot, so they are
+// only kept by the journal, and recorded again whenever it is emptied.
+type journal struct {
+	path     string
+	file     *os.File
+	entries  int
+	baseline bool
+}
+
+type journalEntry struct {
+	Type    EventType  `json:"type"`
+	Chat    *[2]string `json:"chat,omitempty"`
+	Message *Message   `json:"message,omitempty"`
+	Status  *Status    `json:"status,omitempty"`
+	Media   *Media     `json:"media,omitempty"`
+
+	// Messages are set on chat entries for chats created along with their
+	// messages, like the chats loaded from a file.
+	Messages []*Message `json:"messages,omitempty"`
+
+	Webhook  *Webhook  `json:"webhook,omitempty"`
+	Delivery *Delivery `json:"delivery,omitempty"`
+
+	// Snapshot and Path are set on baseline entries, replacing the state
+	// and the snapshot path of the core.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+	Path     string    `json:"path,omitempty"`
+}
+
+// OpenJournal replays the journal at path on top of the current state and
+// starts recording mutations into it. Compacting the journal saves the
+// snapshot to SnapshotPath, which should be the snapshot the core was loaded
+// from, unless the state was replaced since. The core must be locked by the
+// caller.
+func (c *Core) OpenJournal(path string) error {
+	if c.journal != nil {
+		return fmt.Errorf("Journal '%s' already open", c.journal.path)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open journal '%s': %w", path, err)
+	}
+
+	entries, baseline, err := c.replay(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to replay journal '%s': %w", path, err)
+	}
+	if entries > 0 {
+		log.Printf("Replayed %d journal entries from '%s'", entries, path)
+	}
+
+	c.journal = &journal{
+		path:     path,
+		file:     file,
+		entries:  entries,
+		baseline: baseline,
+	}
+
+	return nil
+}
+
+// replay applies the entries of the journal, leaving the file positioned
+// after the last complete entry, and reports whether it has a baseline. A
+// truncated last entry, left by a crash while it was written, is discarded.
+func (c *Core) replay(file *os.File) (entries int, baseline bool, err error) {
+	reader := bufio.NewReader(file)
+
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Discarding truncated journal entry: %s", line)
+			}
+			break
+		}
+		if err != nil {
+			return entries, baseline, err
+		}
+
+		var entry journalEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return entries, baseline, fmt.Errorf("Invalid entry at offset %d: %w", offset, err)
+		}
+
+		c.apply(&entry)
+		baseline = baseline || entry.Snapshot != nil
+		entries++
+		offset += int64(len(line))
+	}
+
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+
+	return entries, baseline, err
+}
+
+// apply replays a journal entry. Entries may already be part of the snapshot
+// if the process died while compacting, so applying them is idempotent.
+func (c *Core) apply(entry *journalEntry) {
+	switch entry.Type {
+	case EventSnapshotLoaded, EventReset:
+		if entry.Snapshot == nil {
+			return
+		}
+		c.SnapshotPath = entry.Path
+		c.setSnapshot(*entry.Snapshot, entry.Type)
+	case EventChatCreated:
+		if entry.Chat == nil {
+			return
+		}
+		chat := c.GetOrCreateChat(*entry.Chat)
+		for _, msg := range entry.Messages {
+			if c.GetMessage(msg.Id) != nil {
+				continue
+			}
+			chat.Messages = append(chat.Messages, msg)
+			c.indexMessage(chat, msg)
+		}
+	case EventMessageCreated:
+		if entry.Chat == nil || entry.Message == nil || c.GetMessage(entry.Message.Id) != nil {
+			return
+		}
+		chat := c.GetOrCreateChat(*entry.Chat)
+		chat.Messages = append(chat.Messages, entry.Message)
+		c.indexMessage(chat, entry.Message)
+	case EventStatusChanged:
+		if entry.Status == nil {
+			return
+		}
+		msg := c.GetMessage(entry.Status.Id)
+		if msg == nil {
+			log.Printf("Skipping status of unknown message '%s'", entry.Status.Id)
+			return
+		}
+		msg.Status = entry.Status.Status
+		msg.Error = nil
+		if len(entry.Status.Errors) > 0 {
+			msg.Error = entry.Status.Errors[0]
+		}
+	case EventMediaAdded:
+		if entry.Media == nil || c.GetMedia(entry.Media.Id) != nil {
+			return
+		}
+		c.Media = append(c.Media, entry.Media)
+		c.indexMedia(entry.Media)
+	case EventWebhookRegistered:
+		if entry.Webhook == nil || c.GetWebhook(entry.Webhook.Id) != nil {
+			return
+		}
+		c.Webhooks = append(c.Webhooks, entry.Webhook)
+	case EventWebhookRemoved:
+		if entry.Webhook == nil {
+			return
+		}
+		c.RemoveWebhook(entry.Webhook.Id)
+		c.Deliveries = slices.DeleteFunc(c.Deliveries, func(d *Delivery) bool {
+			return d.WebhookId == entry.Webhook.Id
+		})
+	case EventDeliveryUpdated:
+		if entry.Delivery != nil {
+			c.restoreDelivery(entry.Delivery)
+		}
+	}
+}
+
+// record appends the mutation described by an event to the journal, if one
+// is open. Replacing the whole snapshot discards the previous entries, and
+// starts the journal over from a baseline of the new state.
+func (c *Core) record(event *Event) {
+	if c.journal == nil {
+		return
+	}
+
+	var entry *journalEntry
+	switch event.Type {
+	case EventChatCreated:
+		entry = &journalEntry{Type: event.Type, Chat: &event.Chat.Members, Messages: event.Chat.Messages}
+	case EventMessageCreated:
+		entry = &journalEntry{Type: event.Type, Chat: &event.Chat.Members, Message: event.Message}
+	case EventStatusChanged:
+		entry = &journalEntry{Type: event.Type, Status: event.Status}
+	case EventMediaAdded:
+		entry = &journalEntry{Type: event.Type, Media: event.Media}
+	case EventWebhookRegistered, EventWebhookRemoved:
+		entry = &journalEntry{Type: event.Type, Webhook: event.Webhook}
+	case EventDeliveryUpdated:
+		entry = &journalEntry{Type: event.Type, Delivery: event.Delivery}
+	case EventSnapshotLoaded, EventReset:
+		if err := c.rebase(event.Type); err != nil {
+			log.Print(err)
+		}
+		return
+	default:
+		return
+	}
+
+	err := c.writeEntry(entry)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	c.journal.entries++
+}
+
+func (c *Core) writeEntry(entry *journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = c.journal.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write journal entry to '%s': %w", c.journal.path, err)
+	}
+
+	return nil
+}
+
+// recordWebhooks records the webhooks and their deliveries into an emptied
+// journal. They are not counted as entries, so that a journal holding
+// nothing else is not compacted again.
+func (c *Core) recordWebhooks() error {
+	for _, webhook := range c.Webhooks {
+		err := c.writeEntry(&journalEntry{Type: EventWebhookRegistered, Webhook: webhook})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, delivery := range c.Deliveries {
+		if c.GetWebhook(delivery.WebhookId) == nil {
+			continue
+		}
+
+		err := c.writeEntry(&journalEntry{Type: EventDeliveryUpdated, Delivery: delivery})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// JournalEntries returns the number of entries recorded since the journal
+// was last compacted, or zero when there is no journal.
+func (c *Core) JournalEntries() int {
+	if c.journal == nil {
+		return 0
+	}
+
+	return c.journal.entries
+}
+
+// Compact saves the snapshot and empties the journal, unless there is nothing
+// to compact. Once the journal has a baseline, the state was replaced since
+// the snapshot was loaded, so the baseline is rewritten with the current
+// state instead of saving over the snapshot file. The core must be locked by
+// the caller.
+func (c *Core) Compact() error {
+	if c.journal == nil || c.journal.entries == 0 {
+		return nil
+	}
+
+	return c.compact()
+}
+
+func (c *Core) compact() error {
+	if c.journal.baseline {
+		entries := c.journal.entries
+		if err := c.rebase(EventSnapshotLoaded); err != nil {
+			return err
+		}
+
+		log.Printf("Compacted %d journal entries into its baseline", entries)
+		return nil
+	}
+
+	err := c.SaveSnapshot(c.SnapshotPath)
+	if err != nil {
+		return fmt.Errorf("Failed to compact journal '%s': %w", c.journal.path, err)
+	}
+
+	err = c.truncateJournal()
+	if err == nil {
+		err = c.recordWebhooks()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %d journal entries into '%s'", c.journal.entries, c.SnapshotPath)
+	c.journal.entries = 0
+	return nil
+}
+
+// rebase empties the journal and records a baseline of the current state.
+func (c *Core) rebase(typ EventType) error {
+	snapshot := c.Snapshot
+	line, err := json.Marshal(&journalEntry{Type: typ, Snapshot: &snapshot, Path: c.SnapshotPath})
+	if err != nil {
+		return fmt.Errorf("Failed to encode journal baseline: %w", err)
+	}
+
+	err = c.truncateJournal()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.journal.file.Write(append(line, '\n'))
+	if err == nil {
+		err = c.journal.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write journal baseline to '%s': %w", c.journal.path, err)
+	}
+
+	err = c.recordWebhooks()
+	if err != nil {
+		return err
+	}
+
+	c.journal.baseline = true
+	c.journal.entries = 0
+	return nil
+}
+
+func (c *Core) truncateJournal() error {
+	err := c.journal.file.Truncate(0)
+	if err == nil {
+		_, err = c.journal.file.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = c.journal.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to truncate journal '%s': %w", c.journal.path, err)
+	}
+
+	return nil
+}
+
+// CloseJournal compacts the journal and stops recording mutations. The core
+// must be locked by the caller.
+func (c *Core) CloseJournal() error {
+	if c.journal == nil {
+		return nil
+	}
+
+	err := c.Compact()
+	if err != nil {
+		return err
+	}
+
+	err = c.journal.file.Close()
+	c.journal = nil
+	return err
+}
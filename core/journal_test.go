@@ -0,0 +1,299 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+// mutate makes one of each of the journaled changes.
+func mutate(t *testing.T, c *Core) {
+	t.Helper()
+
+	addMessages(c, 2)
+	c.MarkRead(c.Chats[0].Messages[0])
+	c.UpdateStatus(c.Chats[0].Messages[1], StatusFailed, NewError(ErrInvalidValue, "Failed"))
+	c.GetOrCreateChat([2]string{"+00", "+22"})
+	if _, err := c.AddMedia("+00", "PNG", []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reopen loads the snapshot and replays the journal into a new core sharing
+// the media store of c, as a restarted process would.
+func reopen(t *testing.T, ctx context.Context, c *Core, journalPath, snapshotPath string) *Core {
+	t.Helper()
+
+	restarted := NewCore(ctx)
+	restarted.MediaStore = c.MediaStore
+	restarted.SnapshotPath = snapshotPath
+	if _, err := os.Stat(snapshotPath); err == nil {
+		if err := restarted.LoadSnapshot(snapshotPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := restarted.OpenJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return restarted
+}
+
+type JournalTest struct {
+	// Compact compacts the journal before the restart.
+	Compact bool
+
+	// Stale restores the journal entries after compacting, as if the
+	// process died before the journal was emptied.
+	Stale bool
+
+	// Garbage is appended to the journal before the restart, as if the
+	// process died while writing an entry.
+	Garbage string
+}
+
+func TestJournalReplay(t *testing.T) {
+	tests := []JournalTest{
+		{},
+		{Garbage: `{"type":"message_cre`},
+		{Compact: true},
+		{Compact: true, Stale: true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dir := t.TempDir()
+			journalPath := filepath.Join(dir, "journal.jsonl")
+			snapshotPath := filepath.Join(dir, "snapshot.json")
+
+			c := NewCore(ctx)
+			c.SnapshotPath = snapshotPath
+			if err := c.OpenJournal(journalPath); err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			mutate(t, c)
+			entries, _ := os.ReadFile(journalPath)
+
+			if test.Compact {
+				if err := c.Compact(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.Stale {
+				os.WriteFile(journalPath, entries, 0644)
+			}
+			if test.Garbage != "" {
+				file, _ := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0644)
+				file.WriteString(test.Garbage)
+				file.Close()
+			}
+
+			restarted := reopen(t, ctx, c, journalPath, snapshotPath)
+
+			// Assert
+			c.Version = restarted.Version
+			if !reflect.DeepEqual(c.Snapshot, restarted.Snapshot) {
+				t.Fatalf("State mismatch. Expected %s, got %s", spew.Sdump(c.Snapshot), spew.Sdump(restarted.Snapshot))
+			}
+
+			// New entries must not be corrupted by a discarded entry.
+			addMessages(restarted, 1)
+			again := reopen(t, ctx, restarted, journalPath, snapshotPath)
+			if len(again.Chats[0].Messages) != 3 {
+				t.Errorf("Expected 3 messages after the second restart, got %s", spew.Sdump(again.Chats[0]))
+			}
+		})
+	}
+}
+
+func TestJournalReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "journal.jsonl")
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+
+	c := newLargeCore(ctx, 3, 0)
+	c.SnapshotPath = snapshotPath
+	if err := c.SaveSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(snapshotPath)
+	if err := c.OpenJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resetting, compacting and closing the journal leave the snapshot
+	// file and its history alone.
+	c.Reset()
+	c.GetOrCreateChat([2]string{"+00", "+11"})
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	c.Reset()
+	addMessages(c, 1)
+	if err := c.CloseJournal(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, _ := os.ReadFile(snapshotPath)
+	if string(current) != string(saved) {
+		t.Errorf("Expected the snapshot file to be unchanged, got %s", current)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Expected only the snapshot and the journal, got %v", files)
+	}
+
+	// The reset state is restored from the journal on restart.
+	restarted := reopen(t, ctx, c, journalPath, snapshotPath)
+	c.Version = restarted.Version
+	if !reflect.DeepEqual(c.Snapshot, restarted.Snapshot) {
+		t.Fatalf("State mismatch. Expected %s, got %s", spew.Sdump(c.Snapshot), spew.Sdump(restarted.Snapshot))
+	}
+}
+
+func TestJournalLoadChat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "journal.jsonl")
+	snapshotPath := filepath.Join(dir, "snapshot.json")
+	chatPath := filepath.Join(dir, "chat.json")
+
+	chat := &Chat{
+		Members: [2]string{"+00", "+33"},
+		Messages: []*Message{
+			{Id: "wamid.1", Timestamp: 1, From: "+33", To: "+00", Type: "text", Text: &TextMessage{Body: "Hi"}},
+			{Id: "wamid.2", Timestamp: 2, From: "+00", To: "+33", Type: "text", Text: &TextMessage{Body: "Hello"}, Status: StatusSent},
+		},
+	}
+	data, _ := json.Marshal(chat)
+	if err := os.WriteFile(chatPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newLargeCore(ctx, 1, 0)
+	c.SnapshotPath = snapshotPath
+	if err := c.SaveSnapshot(snapshotPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The journal is not compacted, so the messages of the loaded chat are
+	// only restored from it.
+	if err := c.LoadChat(chatPath); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := reopen(t, ctx, c, journalPath, snapshotPath)
+	if !reflect.DeepEqual(c.Snapshot, restarted.Snapshot) {
+		t.Fatalf("State mismatch. Expected %s, got %s", spew.Sdump(c.Snapshot), spew.Sdump(restarted.Snapshot))
+	}
+	if restarted.GetMessage("wamid.2") == nil {
+		t.Errorf("Expected the messages of the loaded chat to be restored")
+	}
+}
+
+type JournalWebhooksTest struct {
+	// Compact compacts the journal, and Reset resets the state, before the
+	// restart.
+	Compact bool
+	Reset   bool
+}
+
+func TestJournalWebhooks(t *testing.T) {
+	tests := []JournalWebhooksTest{
+		{},
+		{Compact: true},
+		{Reset: true},
+		{Reset: true, Compact: true},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dir := t.TempDir()
+			journalPath := filepath.Join(dir, "journal.jsonl")
+			snapshotPath := filepath.Join(dir, "snapshot.json")
+
+			c := NewCore(ctx)
+			c.SnapshotPath = snapshotPath
+			if err := c.OpenJournal(journalPath); err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			addMessages(c, 2)
+			webhook := &Webhook{User: "+11", URL: "http://localhost:1", AppSecret: "secret"}
+			c.AddWebhook(webhook)
+			removed := &Webhook{User: "+11", URL: "http://localhost:2"}
+			c.AddWebhook(removed)
+
+			event := &Event{Type: EventMessageCreated, Message: c.Chats[0].Messages[0]}
+			failed := c.AddDelivery(webhook, event, []byte(`{"n":1}`))
+			c.AddAttempt(failed, &Attempt{Time: time.Now(), StatusCode: 500})
+			failed.NextAttempt = time.Now().Add(time.Minute)
+			c.UpdateDelivery(failed)
+			c.AddDelivery(webhook, event, []byte(`{"n":2}`))
+			c.AddDelivery(removed, event, []byte(`{"n":3}`))
+			c.RemoveWebhook(removed.Id)
+
+			if test.Reset {
+				c.Reset()
+			}
+			if test.Compact {
+				if err := c.Compact(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			restarted := reopen(t, ctx, c, journalPath, snapshotPath)
+
+			// Assert
+			if len(restarted.Webhooks) != 1 || !reflect.DeepEqual(restarted.Webhooks[0], webhook) {
+				t.Fatalf("Expected only %s, got %s", spew.Sdump(webhook), spew.Sdump(restarted.Webhooks))
+			}
+
+			expected := c.WebhookDeliveries(webhook.Id)
+			deliveries := restarted.WebhookDeliveries(webhook.Id)
+			if len(restarted.Deliveries) != 2 || len(deliveries) != 2 {
+				t.Fatalf("Expected the 2 deliveries of the webhook, got %s", spew.Sdump(restarted.Deliveries))
+			}
+			for i, delivery := range deliveries {
+				if delivery.Webhook != restarted.Webhooks[0] {
+					t.Errorf("Expected delivery %d to refer to the restored webhook", i)
+				}
+
+				want, _ := json.Marshal(expected[i])
+				got, _ := json.Marshal(delivery)
+				if string(want) != string(got) {
+					t.Errorf("Delivery mismatch. Expected %s, got %s", want, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to a listener whose buffer is full when
+// a new event is broadcast. Events are never delivered with a blocking send,
+// so a slow listener can not hold back the core or the other listeners.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered event to make room for the
+	// new one.
+	DropOldest OverflowPolicy = iota
+
+	// Disconnect removes the listener and closes its channel.
+	Disconnect
+)
+
+type ListenerOptions struct {
+	Buffer   int
+	Overflow OverflowPolicy
+
+	// Filter selects the events delivered to the listener. Events that do
+	// not match are skipped without taking room in the buffer.
+	Filter EventFilter
+}
+
+var DefaultListenerOptions = ListenerOptions{
+	Buffer:   100,
+	Overflow: DropOldest,
+}
+
+// Listener receives the events broadcast by the core on C, which is closed
+// when the listener is disconnected or the core context is done.
+type Listener struct {
+	C <-chan *Event
+
+	c       chan *Event
+	options ListenerOptions
+	dropped atomic.Uint64
+}
+
+// Dropped returns the number of events the listener missed because its buffer
+// was full.
+func (l *Listener) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+type ListenerStats struct {
+	Listeners    int64
+	Published    uint64
+	Dropped      uint64
+	Disconnected uint64
+}
+
+type listenerStats struct {
+	listeners    atomic.Int64
+	published    atomic.Uint64
+	dropped      atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+func (c *Core) ListenerStats() ListenerStats {
+	return ListenerStats{
+		Listeners:    c.stats.listeners.Load(),
+		Published:    c.stats.published.Load(),
+		Dropped:      c.stats.dropped.Load(),
+		Disconnected: c.stats.disconnected.Load(),
+	}
+}
+
+// AddListener subscribes to the events of the core. A zero buffer size uses
+// the one of DefaultListenerOptions.
+func (c *Core) AddListener(options ListenerOptions) *Listener {
+	if options.Buffer <= 0 {
+		options.Buffer = DefaultListenerOptions.Buffer
+	}
+
+	ch := make(chan *Event, options.Buffer)
+	l := &Listener{C: ch, c: ch, options: options}
+
+	select {
+	case c.addListener <- l:
+	case <-c.ctx.Done():
+		close(ch)
+	}
+
+	return l
+}
+
+func (c *Core) RemoveListener(l *Listener) {
+	select {
+	case c.removeListener <- l:
+	case <-c.ctx.Done():
+	}
+}
+
+// publish records an event in the journal and hands it to the listener loop.
+// It only blocks while the loop is handing the previous events over, which
+// never blocks itself.
+func (c *Core) publish(event *Event) {
+	c.record(event)
+
+	select {
+	case c.events <- event:
+	case <-c.ctx.Done():
+	}
+}
+
+// Flush waits until the events published so far were handed to the
+// listeners, so that they are in the listener channels once it returns. The
+// core must not be locked by the caller, as publishing may be waiting for the
+// listener loop.
+func (c *Core) Flush() {
+	flushed := make(chan struct{})
+
+	select {
+	case c.events <- &Event{flushed: flushed}:
+	case <-c.ctx.Done():
+		return
+	}
+
+	select {
+	case <-flushed:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *Core) notifyListeners() {
+	listeners := map[*Listener]bool{}
+	done := c.ctx.Done()
+
+	defer func() {
+		for listener := range listeners {
+			close(listener.c)
+		}
+		c.stats.listeners.Store(0)
+	}()
+
+	for {
+		select {
+		case event := <-c.events:
+			// Events are handled in order, so a Flush is done once its
+			// event is reached.
+			if event.flushed != nil {
+				close(event.flushed)
+				continue
+			}
+
+			c.stats.published.Add(1)
+			for listener := range listeners {
+				if !listener.options.Filter.Matches(event) {
+					continue
+				}
+				if !c.deliver(listener, event) {
+					delete(listeners, listener)
+					close(listener.c)
+				}
+			}
+		case listener := <-c.addListener:
+			listeners[listener] = true
+		case listener := <-c.removeListener:
+			if listeners[listener] {
+				delete(listeners, listener)
+				close(listener.c)
+			}
+		case <-done:
+			return
+		}
+
+		c.stats.listeners.Store(int64(len(listeners)))
+	}
+}
+
+// deliver sends event to listener without blocking, applying the listener's
+// overflow policy if its buffer is full. It returns false if the listener
+// must be disconnected.
+func (c *Core) deliver(listener *Listener, event *Event) bool {
+	select {
+	case listener.c <- event:
+		return true
+	default:
+	}
+
+	listener.dropped.Add(1)
+	c.stats.dropped.Add(1)
+
+	switch listener.options.Overflow {
+	case Disconnect:
+		log.Printf("Disconnected slow listener after %d events", cap(listener.c))
+		c.stats.disconnected.Add(1)
+		return false
+	default:
+		select {
+		case <-listener.c:
+		default:
+		}
+
+		select {
+		case listener.c <- event:
+		default:
+		}
+		return true
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// MediaStore keeps the contents of media outside of the snapshot, addressed
+// by their SHA-256 hash. Stores are used without holding the core lock, so
+// they must be safe for concurrent use.
+type MediaStore interface {
+	Put(hash []byte, data []byte) error
+
+	// Open returns the blob with the given hash, or an error wrapping
+	// fs.ErrNotExist if there is none.
+	Open(hash []byte) (io.ReadSeekCloser, error)
+}
+
+// MemoryMediaStore keeps blobs in memory. As snapshots only reference blobs,
+// they are lost when the snapshot is saved and loaded by another process.
+type MemoryMediaStore struct {
+	lock  sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryMediaStore() *MemoryMediaStore {
+	return &MemoryMediaStore{blobs: map[string][]byte{}}
+}
+
+func (s *MemoryMediaStore) Put(hash []byte, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.blobs[string(hash)] = data
+	return nil
+}
+
+func (s *MemoryMediaStore) Open(hash []byte) (io.ReadSeekCloser, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	data, found := s.blobs[string(hash)]
+	if !found {
+		return nil, fmt.Errorf("Blob '%x' not found: %w", hash, fs.ErrNotExist)
+	}
+
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// DirMediaStore keeps each blob in a file of Dir named after the hex encoding
+// of its hash, in a subdirectory named after the first two characters of the
+// hash. Blobs are never modified once written, so they are shared between
+// all the snapshots using the same directory.
+type DirMediaStore struct {
+	Dir string
+}
+
+func (s *DirMediaStore) path(hash []byte) (string, error) {
+	if len(hash) != sha256.Size {
+		return "", fmt.Errorf("Invalid blob hash '%x'", hash)
+	}
+
+	name := hex.EncodeToString(hash)
+	return filepath.Join(s.Dir, name[:2], name), nil
+}
+
+func (s *DirMediaStore) Put(hash []byte, data []byte) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create media directory '%s': %w", filepath.Dir(path), err)
+	}
+
+	// Blobs are renamed into place once complete, so a crash never leaves a
+	// truncated blob behind.
+	file, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return fmt.Errorf("Failed to create blob '%s': %w", path, err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write blob '%s': %w", path, err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("Failed to write blob '%s': %w", path, err)
+	}
+
+	return nil
+}
+
+func (s *DirMediaStore) Open(hash []byte) (io.ReadSeekCloser, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open blob '%s': %w", path, err)
+	}
+
+	return file, nil
+}
+
+// OpenMedia returns the contents of media. The core does not need to be
+// locked, as media are never modified once added.
+func (c *Core) OpenMedia(media *Media) (io.ReadSeekCloser, error) {
+	if media.Data != nil {
+		return nopCloser{bytes.NewReader(media.Data)}, nil
+	}
+
+	return c.MediaStore.Open(media.Hash)
+}
+
+// storeInlineMedia moves the contents of the media of snapshots that predate
+// the media store into it. Media that can not be stored keep their contents
+// inline, so they can still be served.
+func (c *Core) storeInlineMedia() {
+	for _, media := range c.Media {
+		if media.Data == nil {
+			continue
+		}
+
+		media.Size = int64(len(media.Data))
+
+		hash := sha256.Sum256(media.Data)
+		err := c.MediaStore.Put(hash[:], media.Data)
+		if err != nil {
+			log.Printf("Failed to store media '%s': %v", media.Id, err)
+			continue
+		}
+
+		media.Hash = hash[:]
+		media.Data = nil
+	}
+}
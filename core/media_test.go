@@ -0,0 +1,54 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+func TestMediaStores(t *testing.T) {
+	stores := map[string]MediaStore{
+		"memory": NewMemoryMediaStore(),
+		"dir":    &DirMediaStore{Dir: t.TempDir()},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+
+			// Arrange
+			data := []byte("0123456789")
+			hash := sha256.Sum256(data)
+			missing := sha256.Sum256([]byte("missing"))
+
+			// Act
+			err := store.Put(hash[:], data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.Put(hash[:], data)
+			if err != nil {
+				t.Fatalf("Storing a blob twice failed: %v", err)
+			}
+
+			// Assert
+			blob, err := store.Open(hash[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blob.Close()
+
+			blob.Seek(5, io.SeekStart)
+			rest, err := io.ReadAll(blob)
+			if err != nil || string(rest) != "56789" {
+				t.Errorf("Expected blob contents after seeking, got '%s' (%v)", rest, err)
+			}
+
+			_, err = store.Open(missing[:])
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected a missing blob error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// migrations upgrade the JSON encoding of snapshots, migrations[v] taking a
+// snapshot from version v to v+1. Snapshots saved before versioning have no
+// version field, and are detected by snapshotVersion.
+var migrations = []func(snapshot map[string]any) error{
+	migrateSingleUserChats,
+	migrateMessageIds,
+}
+
+// SnapshotVersion is the version of the snapshots written by this package.
+var SnapshotVersion = len(migrations)
+
+// LegacyOwner is the number assumed to own the chats of version 0 snapshots,
+// which only recorded the peer of each chat. It defaults to the default web
+// user.
+var LegacyOwner = "agent"
+
+// snapshotVersion returns the version of an encoded snapshot. Snapshots
+// without a version are version 1, which chats between participants but
+// messages without ids or timestamps, unless they use the single user chat
+// layout of version 0.
+func snapshotVersion(snapshot map[string]any) (int, error) {
+	if version, found := snapshot["version"]; found {
+		number, ok := version.(json.Number)
+		if !ok {
+			return 0, fmt.Errorf("Invalid snapshot version '%v'", version)
+		}
+
+		v, err := number.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("Invalid snapshot version '%v'", version)
+		}
+
+		return int(v), nil
+	}
+
+	chats, _ := snapshot["chats"].([]any)
+	for _, chat := range chats {
+		chat, _ := chat.(map[string]any)
+		if _, found := chat["user"]; found {
+			return 0, nil
+		}
+	}
+
+	return 1, nil
+}
+
+// migrateSnapshot upgrades an encoded snapshot to SnapshotVersion, returning
+// the migrated encoding and the version it had.
+func migrateSnapshot(data []byte) ([]byte, int, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	err := json.Unmarshal(data, &probe)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to decode snapshot: %w", err)
+	}
+
+	if probe.Version == SnapshotVersion {
+		return data, probe.Version, nil
+	}
+
+	var snapshot map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err = dec.Decode(&snapshot)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to decode snapshot: %w", err)
+	}
+
+	from, err := snapshotVersion(snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if from > SnapshotVersion {
+		return nil, from, fmt.Errorf("Snapshot version %d is newer than the supported version %d", from, SnapshotVersion)
+	}
+
+	for version := from; version < SnapshotVersion; version++ {
+		err = migrations[version](snapshot)
+		if err != nil {
+			return nil, from, fmt.Errorf("Failed to migrate snapshot from version %d: %w", version, err)
+		}
+	}
+
+	snapshot["version"] = SnapshotVersion
+	data, err = json.Marshal(snapshot)
+	if err != nil {
+		return nil, from, fmt.Errorf("Failed to encode snapshot: %w", err)
+	}
+
+	if from != SnapshotVersion {
+		log.Printf("Migrated snapshot from version %d to %d", from, SnapshotVersion)
+	}
+	return data, from, nil
+}
+
+// migrateSingleUserChats converts the chats of version 0, which had a single
+// "user" peer and messages without a sender, into chats between LegacyOwner
+// and the peer.
+func migrateSingleUserChats(snapshot map[string]any) error {
+	chats, _ := snapshot["chats"].([]any)
+	for i, chat := range chats {
+		chat, ok := chat.(map[string]any)
+		if !ok {
+			return fmt.Errorf("Invalid chat %d", i)
+		}
+
+		peer, _ := chat["user"].(string)
+		delete(chat, "user")
+		chat["participants"] = []any{LegacyOwner, peer}
+
+		messages, _ := chat["messages"].([]any)
+		for j, msg := range messages {
+			msg, ok := msg.(map[string]any)
+			if !ok {
+				return fmt.Errorf("Invalid message %d of chat %d", j, i)
+			}
+
+			if from, _ := msg["from"].(string); from != "" {
+				continue
+			}
+
+			if to, _ := msg["to"].(string); to == peer {
+				msg["from"] = LegacyOwner
+			} else {
+				msg["from"] = peer
+				msg["to"] = LegacyOwner
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateMessageIds gives the messages of version 1, which had no id or
+// timestamp, a fresh id and the current time, so that they can be looked up,
+// marked as read and reported in status webhooks.
+func migrateMessageIds(snapshot map[string]any) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	chats, _ := snapshot["chats"].([]any)
+	for i, chat := range chats {
+		chat, ok := chat.(map[string]any)
+		if !ok {
+			return fmt.Errorf("Invalid chat %d", i)
+		}
+
+		messages, _ := chat["messages"].([]any)
+		for j, msg := range messages {
+			msg, ok := msg.(map[string]any)
+			if !ok {
+				return fmt.Errorf("Invalid message %d of chat %d", j, i)
+			}
+
+			if id, _ := msg["id"].(string); id == "" {
+				msg["id"] = newMessageId()
+			}
+
+			switch timestamp := msg["timestamp"].(type) {
+			case string:
+				if timestamp != "" && timestamp != "0" {
+					continue
+				}
+			case json.Number:
+				if timestamp != "0" {
+					msg["timestamp"] = timestamp.String()
+					continue
+				}
+			}
+			msg["timestamp"] = now
+		}
+	}
+
+	return nil
+}
+
+// MigrateSnapshotFile upgrades the snapshot at path to SnapshotVersion in
+// place, returning the version it had. Snapshots that are already up to date
+// are left untouched.
+func MigrateSnapshotFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open snapshot '%s': %w", path, err)
+	}
+
+	// The media of archives are kept in memory until the archive is written
+	// back, while inline media are written back as they were.
+	c := &Core{MediaStore: NewMemoryMediaStore()}
+	snapshot, from, err := c.readSnapshot(file, FormatOf(path))
+	file.Close()
+	if err != nil {
+		return from, fmt.Errorf("Failed to read snapshot '%s': %w", path, err)
+	}
+
+	if from == SnapshotVersion {
+		return from, nil
+	}
+
+	c.Snapshot = snapshot
+	return from, c.SaveSnapshot(path)
+}
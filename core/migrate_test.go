@@ -0,0 +1,192 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+const legacySnapshot = `{
+	"chats": [
+		{
+			"user": "+11",
+			"messages": [
+				{"to": "+11", "type": "text", "text": {"body": "Sup?"}},
+				{"to": "+00", "type": "text", "text": {"body": "Nothing"}}
+			]
+		}
+	],
+	"media": [{"id": "image", "user": "+00", "type": "PNG", "data": "aW1hZ2U="}]
+}`
+
+func TestMigrateLegacySnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCore(ctx)
+	snapshot, err := c.ReadSnapshot(strings.NewReader(legacySnapshot), FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range snapshot.Chats[0].Messages {
+		if msg.Id == "" || msg.Timestamp == 0 {
+			t.Errorf("Expected migrated message to have an id and timestamp, got %+v", msg)
+		}
+		msg.Id, msg.Timestamp = "", 0
+	}
+
+	expected := []*Chat{{
+		Members: [2]string{LegacyOwner, "+11"},
+		Messages: []*Message{
+			{From: LegacyOwner, To: "+11", Type: "text", Text: &TextMessage{Body: "Sup?"}},
+			{From: "+11", To: LegacyOwner, Type: "text", Text: &TextMessage{Body: "Nothing"}},
+		},
+	}}
+	if snapshot.Version != SnapshotVersion || !reflect.DeepEqual(snapshot.Chats, expected) {
+		t.Errorf("Migration mismatch. Expected %s, got %s", spew.Sdump(expected), spew.Sdump(snapshot))
+	}
+	if string(snapshot.Media[0].Data) != "image" {
+		t.Errorf("Expected inline media to be kept, got %+v", snapshot.Media[0])
+	}
+}
+
+// baselineSnapshot was saved by the first release, which chatted between
+// participants but did not version snapshots or give messages an id or a
+// timestamp.
+const baselineSnapshot = `{
+  "chats": [
+    {
+      "participants": ["agent", "+5511"],
+      "messages": [
+        {"from": "+5511", "to": "agent", "type": "text", "text": {"body": "Hello"}},
+        {"from": "agent", "to": "+5511", "type": "text", "text": {"body": "Hi, how can I help?"}},
+        {"from": "+5511", "to": "agent", "type": "image", "image": {"id": "dbf2ce13-ce88-4feb-9f8d-00a56a2a80c6", "caption": "Receipt"}}
+      ]
+    },
+    {
+      "participants": ["agent", "+5522"],
+      "messages": [
+        {"from": "agent", "to": "+5522", "type": "text", "text": {"body": "Your order shipped"}}
+      ]
+    }
+  ],
+  "media": [
+    {
+      "id": "dbf2ce13-ce88-4feb-9f8d-00a56a2a80c6",
+      "user": "+5511",
+      "type": "PNG",
+      "data": "aW1hZ2U=",
+      "hash": "YQXWzHavQAMl6U1YjOURvlv9u3O0N9xR7KQ5F9ekPj0="
+    }
+  ]
+}`
+
+func TestMigrateBaselineSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	err := os.WriteFile(path, []byte(baselineSnapshot), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCore(ctx)
+	err = c.LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.Version != SnapshotVersion {
+		t.Errorf("Expected snapshot version %d, got %d", SnapshotVersion, c.Version)
+	}
+
+	ids := map[string]bool{}
+	for _, chat := range c.Chats {
+		for _, msg := range chat.Messages {
+			if !strings.HasPrefix(msg.Id, "wamid.") || ids[msg.Id] || msg.Timestamp == 0 {
+				t.Errorf("Expected migrated message to have a unique id and a timestamp, got %+v", msg)
+			}
+			ids[msg.Id] = true
+
+			if c.GetMessage(msg.Id) != msg {
+				t.Errorf("Expected message '%s' to be found", msg.Id)
+			}
+		}
+	}
+	if len(ids) != 4 {
+		t.Errorf("Expected 4 messages, got %d", len(ids))
+	}
+	if c.GetMessage("") != nil {
+		t.Errorf("Expected no message with an empty id")
+	}
+}
+
+func TestMigrateNewerSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewCore(ctx)
+	_, err := c.ReadSnapshot(strings.NewReader(`{"version": 999}`), FormatJSON)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected newer version error, got %v", err)
+	}
+}
+
+type MigrateSnapshotFileTest struct {
+	Snapshot string
+	From     int
+}
+
+func TestMigrateSnapshotFile(t *testing.T) {
+	tests := []MigrateSnapshotFileTest{
+		{Snapshot: legacySnapshot, From: 0},
+		{Snapshot: baselineSnapshot, From: 1},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+			// Arrange
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			err := os.WriteFile(path, []byte(test.Snapshot), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Act
+			from, err := MigrateSnapshotFile(path)
+			if err != nil || from != test.From {
+				t.Fatalf("Expected migration from version %d, got %d (%v)", test.From, from, err)
+			}
+
+			migrated, _ := os.ReadFile(path)
+			from, err = MigrateSnapshotFile(path)
+			if err != nil || from != SnapshotVersion {
+				t.Fatalf("Expected migrated snapshot to be up to date, got %d (%v)", from, err)
+			}
+
+			// Assert
+			again, _ := os.ReadFile(path)
+			if !bytes.Equal(migrated, again) {
+				t.Errorf("Expected up to date snapshot to be left untouched")
+			}
+			if !bytes.Contains(migrated, []byte(`"participants"`)) || !bytes.Contains(migrated, []byte(`"data": "aW1hZ2U="`)) {
+				t.Errorf("Unexpected migrated snapshot: %s", migrated)
+			}
+			if !bytes.Contains(migrated, []byte(`"id": "wamid.`)) || bytes.Contains(migrated, []byte(`"timestamp": "0"`)) {
+				t.Errorf("Expected migrated messages to have ids and timestamps: %s", migrated)
+			}
+		})
+	}
+}
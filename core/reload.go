@@ -0,0 +1,101 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotFiles lists the snapshots in the directory of SnapshotPath, which
+// can be switched to with SwitchSnapshot. The core must be locked by the
+// caller, at least for reading.
+func (c *Core) SnapshotFiles() ([]*SnapshotFile, error) {
+	dir := filepath.Dir(c.SnapshotPath)
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list snapshots '%s': %w", dir, err)
+	}
+
+	return files, nil
+}
+
+// SwitchSnapshot loads the snapshot named name in the directory of
+// SnapshotPath, as listed by SnapshotFiles, and makes it the current
+// snapshot, which later reloads read and explicit saves replace. Like any
+// load, the switch is recorded as the baseline of the journal when one is
+// open, leaving the snapshot file as is. The current snapshot is kept if the
+// new one can not be loaded. The core must be locked by the caller.
+func (c *Core) SwitchSnapshot(name string) error {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") || !isSnapshotName(name) {
+		return fmt.Errorf("Invalid snapshot name '%s'", name)
+	}
+
+	// The path is switched before loading, so that the journal baseline
+	// records the new path, which a restart restores along with the state.
+	previous := c.SnapshotPath
+	c.SnapshotPath = filepath.Join(filepath.Dir(previous), name)
+
+	err := c.LoadSnapshot(c.SnapshotPath)
+	if err != nil {
+		c.SnapshotPath = previous
+		return err
+	}
+
+	log.Printf("Switched to snapshot '%s'", c.SnapshotPath)
+	return nil
+}
+
+// ReloadSnapshot replaces the state of the core with the snapshot at
+// SnapshotPath, discarding the changes made since it was saved. The core
+// must be locked by the caller.
+func (c *Core) ReloadSnapshot() error {
+	return c.LoadSnapshot(c.SnapshotPath)
+}
+
+// Reset discards the chats and media of the core, notifying the listeners
+// with an EventReset. The business accounts, phone numbers, access tokens
+// and registered webhooks are kept, so clients keep working against the
+// empty state. Like loading a snapshot, the reset is recorded as the baseline
+// of the journal when one is open, leaving the snapshot file as is. The core
+// must be locked by the caller.
+func (c *Core) Reset() {
+	c.setSnapshot(Snapshot{
+		PhoneNumbers:     c.PhoneNumbers,
+		AccessTokens:     c.AccessTokens,
+		BusinessAccounts: c.BusinessAccounts,
+	}, EventReset)
+	log.Print("Reset the state")
+}
+
+// WatchSnapshot reloads the snapshot whenever SnapshotPath is modified other
+// than by the core, checking it at every interval until ctx is done.
+func (c *Core) WatchSnapshot(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.Lock()
+		info, err := os.Stat(c.SnapshotPath)
+		if err == nil && info.ModTime().UnixNano() != c.snapshotModTime.Load() {
+			// An invalid file, such as one still being written by an editor,
+			// is only reported once per modification.
+			c.snapshotModTime.Store(info.ModTime().UnixNano())
+
+			log.Printf("Snapshot '%s' was modified, reloading", c.SnapshotPath)
+			if err := c.ReloadSnapshot(); err != nil {
+				log.Print(err)
+			}
+		}
+		c.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSwitchSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	for name, chats := range map[string]int{"one.json": 1, "two.zip": 2} {
+		err := newLargeCore(ctx, chats, 0).SaveSnapshot(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a snapshot"), 0644)
+
+	c := NewCore(ctx)
+	c.SnapshotPath = filepath.Join(dir, "one.json")
+	if err := c.ReloadSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := c.SnapshotFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "one.json" || files[1].Name != "two.zip" {
+		t.Errorf("Expected one.json and two.zip, got %v", files)
+	}
+
+	err = c.SwitchSnapshot("two.zip")
+	if err != nil || len(c.Chats) != 2 || c.SnapshotPath != filepath.Join(dir, "two.zip") {
+		t.Errorf("Expected to switch to two.zip, got %d chats from '%s' (%v)", len(c.Chats), c.SnapshotPath, err)
+	}
+
+	for _, name := range []string{"../one.json", ".hidden.json", "notes.txt", "missing.json"} {
+		if err := c.SwitchSnapshot(name); err == nil {
+			t.Errorf("Expected switching to '%s' to fail", name)
+		}
+		if c.SnapshotPath != filepath.Join(dir, "two.zip") || len(c.Chats) != 2 {
+			t.Errorf("Expected a failed switch to '%s' to keep two.zip, got '%s'", name, c.SnapshotPath)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newLargeCore(ctx, 3, 3)
+	c.AccessTokens = []*AccessToken{{Number: "+00", Token: "secret"}}
+	listener := c.AddListener(ListenerOptions{
+		Buffer: 1,
+		Filter: EventFilter{Types: []EventType{EventReset}, Users: []string{"+00"}},
+	})
+	waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+
+	c.Reset()
+
+	if len(c.Chats) != 0 || len(c.Media) != 0 || c.GetMessage("wamid.0") != nil {
+		t.Errorf("Expected no chats, media or messages, got %d chats and %d media", len(c.Chats), len(c.Media))
+	}
+	if c.GetAccessToken("secret") == nil {
+		t.Error("Expected the access tokens to be kept")
+	}
+
+	select {
+	case event := <-listener.C:
+		if event.Type != EventReset {
+			t.Errorf("Expected a reset event, got %s", event.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("Timed out waiting for the reset event")
+	}
+}
+
+func TestWatchSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	c := NewCore(ctx)
+	c.SnapshotPath = path
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	listener := c.AddListener(ListenerOptions{
+		Buffer: 10,
+		Filter: EventFilter{Types: []EventType{EventSnapshotLoaded}},
+	})
+	waitFor(t, "listener", func() bool { return c.ListenerStats().Listeners == 1 })
+	go c.WatchSnapshot(ctx, time.Millisecond)
+
+	// Saves of the core itself are not reloaded.
+	c.Lock()
+	c.GetOrCreateChat([2]string{"+00", "+11"})
+	err := c.SaveSnapshot(path)
+	c.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if len(listener.C) != 0 {
+		t.Fatal("Expected the core's own save not to be reloaded")
+	}
+
+	// Another process writing the snapshot is.
+	err = newLargeCore(ctx, 3, 0).SaveSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-listener.C:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the snapshot to be reloaded")
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.Chats) != 3 {
+		t.Errorf("Expected the modified snapshot with 3 chats, got %d", len(c.Chats))
+	}
+}
+
+// Saving only takes the read lock, so concurrent saves must not race on the
+// state kept for WatchSnapshot.
+func TestConcurrentSaves(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	c := newLargeCore(ctx, 3, 0)
+	c.SnapshotPath = path
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c.RLock()
+			defer c.RUnlock()
+			if err := c.SaveSnapshot(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().UnixNano() != c.snapshotModTime.Load() {
+		t.Error("Expected the modification time of the last save to be kept")
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cloud API error codes reported for messages that can not be sent.
+const (
+	ErrInvalidParameter = 100
+	ErrInvalidValue     = 131009
+	ErrUnsupportedType  = 131051
+	ErrMediaUpload      = 131053
+	ErrUndeliverable    = 131026
+)
+
+const (
+	MaxTextLength    = 4096
+	MaxCaptionLength = 1024
+)
+
+func NewError(code int, details string, args ...any) *Error {
+	titles := map[int]string{
+		ErrInvalidParameter: "Invalid parameter",
+		ErrInvalidValue:     "Parameter value is not valid",
+		ErrUnsupportedType:  "Unsupported message type",
+		ErrMediaUpload:      "Media upload error",
+		ErrUndeliverable:    "Message undeliverable",
+	}
+
+	return &Error{
+		Code:      code,
+		Title:     titles[code],
+		Message:   titles[code],
+		ErrorData: &ErrorData{Details: fmt.Sprintf(details, args...)},
+	}
+}
+
+// ValidateMessage checks that msg would be accepted by the Cloud API, returning
+// the error it would report otherwise. Media and reacted message ids are
+// looked up, so the core must be locked by the caller.
+func (c *Core) ValidateMessage(msg *Message) *Error {
+	if msg.To == "" {
+		return NewError(ErrInvalidParameter, "The parameter to is required.")
+	}
+
+	switch msg.Type {
+	case "text":
+		if msg.Text == nil || msg.Text.Body == "" {
+			return NewError(ErrInvalidParameter, "The parameter text['body'] is required.")
+		}
+		if utf8.RuneCountInString(msg.Text.Body) > MaxTextLength {
+			return NewError(ErrInvalidParameter, "Param text['body'] must be at most %d characters long.", MaxTextLength)
+		}
+	case "image":
+		if msg.Image == nil {
+			return NewError(ErrInvalidParameter, "The parameter image is required.")
+		}
+		if err := c.validateMedia("image", msg.Image.MediaId, msg.Image.Caption); err != nil {
+			return err
+		}
+	case "audio":
+		if msg.Audio == nil {
+			return NewError(ErrInvalidParameter, "The parameter audio is required.")
+		}
+		if msg.Audio.Caption != "" {
+			return NewError(ErrInvalidValue, "Param audio['caption'] is not supported for audio messages.")
+		}
+		if err := c.validateMedia("audio", msg.Audio.MediaId, ""); err != nil {
+			return err
+		}
+	case "document":
+		if msg.Document == nil {
+			return NewError(ErrInvalidParameter, "The parameter document is required.")
+		}
+		if err := c.validateMedia("document", msg.Document.MediaId, msg.Document.Caption); err != nil {
+			return err
+		}
+	case "reaction":
+		if msg.Reaction == nil {
+			return NewError(ErrInvalidParameter, "The parameter reaction is required.")
+		}
+		if msg.Reaction.MessageId == "" {
+			return NewError(ErrInvalidParameter, "The parameter reaction['message_id'] is required.")
+		}
+
+		// Only the messages of the same chat can be reacted to.
+		target := c.GetMessage(msg.Reaction.MessageId)
+		if target == nil || !sameMembers(target, msg) {
+			return NewError(ErrInvalidValue, "Unknown message id '%s'.", msg.Reaction.MessageId)
+		}
+	default:
+		return NewError(ErrUnsupportedType, "Message type '%s' is not supported.", msg.Type)
+	}
+
+	return nil
+}
+
+func sameMembers(a, b *Message) bool {
+	members := []string{a.From, a.To}
+	return slices.Contains(members, b.From) && slices.Contains(members, b.To)
+}
+
+func (c *Core) validateMedia(typ, id, caption string) *Error {
+	if id == "" {
+		return NewError(ErrInvalidParameter, "The parameter %s['id'] is required.", typ)
+	}
+
+	if utf8.RuneCountInString(caption) > MaxCaptionLength {
+		return NewError(ErrInvalidParameter, "Param %s['caption'] must be at most %d characters long.", typ, MaxCaptionLength)
+	}
+
+	media := c.GetMedia(id)
+	if media == nil {
+		return NewError(ErrMediaUpload, "Unknown media id '%s'.", id)
+	}
+
+	contentType := media.ContentType()
+	if (typ == "image" || typ == "audio") && !strings.HasPrefix(contentType, typ+"/") {
+		return NewError(ErrMediaUpload, "Media '%s' of type '%s' can not be sent as %s.", id, contentType, typ)
+	}
+
+	return nil
+}
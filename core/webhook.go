@@ -0,0 +1,261 @@
+package core
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	// MaxDeliveries bounds the number of finished deliveries kept in the
+	// delivery log. Pending deliveries are never discarded.
+	MaxDeliveries = 500
+
+	// MaxDeliveryAttempts bounds the number of attempts kept for each
+	// delivery. Only the most recent ones are kept.
+	MaxDeliveryAttempts = 20
+)
+
+// Webhook is an endpoint that receives the messages sent to a simulated
+// number, and the status changes of the messages it sends.
+type Webhook struct {
+	Id          string `json:"id"`
+	User        string `json:"user"`
+	URL         string `json:"url"`
+	VerifyToken string `json:"verify_token,omitempty"`
+
+	// AppSecret is used to sign payloads in the X-Hub-Signature-256 header.
+	// When BadSignature is set, payloads are sent with an invalid signature
+	// instead.
+	AppSecret    string `json:"app_secret,omitempty"`
+	BadSignature bool   `json:"bad_signature,omitempty"`
+}
+
+// Delivery is a webhook payload, together with the attempts made to send it.
+// Type is the type of the event delivered, and MessageId the message it is
+// about.
+type Delivery struct {
+	Id           string          `json:"id"`
+	Webhook      *Webhook        `json:"-"`
+	WebhookId    string          `json:"webhook_id"`
+	Type         EventType       `json:"type"`
+	MessageId    string          `json:"message_id,omitempty"`
+	Body         json.RawMessage `json:"body"`
+	Created      time.Time       `json:"created"`
+	State        string          `json:"state"`
+	NextAttempt  time.Time       `json:"next_attempt"`
+	AttemptCount int             `json:"attempt_count"`
+	Attempts     []*Attempt      `json:"attempts"`
+}
+
+type Attempt struct {
+	Time       time.Time     `json:"time"`
+	Duration   time.Duration `json:"duration"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Response   string        `json:"response,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+func (a *Attempt) Succeeded() bool {
+	return a.Error == "" && a.StatusCode/100 == 2
+}
+
+func (c *Core) AddWebhook(webhook *Webhook) string {
+	webhook.Id = uuid.NewString()
+	c.Webhooks = append(c.Webhooks, webhook)
+	c.publish(&Event{Type: EventWebhookRegistered, Webhook: webhook})
+
+	return webhook.Id
+}
+
+// RemoveWebhook unregisters a webhook, giving up on its pending deliveries.
+func (c *Core) RemoveWebhook(id string) {
+	webhook := c.GetWebhook(id)
+	if webhook == nil {
+		return
+	}
+
+	c.Webhooks = slices.DeleteFunc(c.Webhooks, func(w *Webhook) bool {
+		return w == webhook
+	})
+	c.publish(&Event{Type: EventWebhookRemoved, Webhook: webhook})
+
+	for _, delivery := range c.Deliveries {
+		if delivery.Webhook.Id == id && delivery.State == DeliveryPending {
+			delivery.State = DeliveryFailed
+			c.UpdateDelivery(delivery)
+		}
+	}
+}
+
+// ClearWebhooks unregisters every webhook and forgets their deliveries,
+// returning the webhooks removed.
+func (c *Core) ClearWebhooks() []*Webhook {
+	webhooks := slices.Clone(c.Webhooks)
+	for _, webhook := range webhooks {
+		c.RemoveWebhook(webhook.Id)
+	}
+	c.Deliveries = nil
+
+	return webhooks
+}
+
+// DiscardDeliveries gives up on every pending delivery, which would refer to
+// messages that are gone once the state is replaced.
+func (c *Core) DiscardDeliveries() {
+	for _, delivery := range c.Deliveries {
+		if delivery.State == DeliveryPending {
+			delivery.State = DeliveryFailed
+			c.UpdateDelivery(delivery)
+		}
+	}
+}
+
+func (c *Core) GetWebhook(id string) *Webhook {
+	for _, webhook := range c.Webhooks {
+		if webhook.Id == id {
+			return webhook
+		}
+	}
+
+	return nil
+}
+
+// FindWebhook returns the webhook of user sending events to url, if any.
+func (c *Core) FindWebhook(user, url string) *Webhook {
+	for _, webhook := range c.Webhooks {
+		if webhook.User == user && webhook.URL == url {
+			return webhook
+		}
+	}
+
+	return nil
+}
+
+// UserWebhooks returns the webhooks that receive the events of user.
+func (c *Core) UserWebhooks(user string) []*Webhook {
+	var webhooks []*Webhook
+	for _, webhook := range c.Webhooks {
+		if webhook.User == user {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks
+}
+
+// AddDelivery queues body to be sent to webhook, discarding the oldest
+// finished deliveries once the log grows over MaxDeliveries.
+func (c *Core) AddDelivery(webhook *Webhook, event *Event, body []byte) *Delivery {
+	now := time.Now()
+	delivery := &Delivery{
+		Id:          uuid.NewString(),
+		Webhook:     webhook,
+		WebhookId:   webhook.Id,
+		Type:        event.Type,
+		Body:        body,
+		Created:     now,
+		State:       DeliveryPending,
+		NextAttempt: now,
+	}
+	if event.Message != nil {
+		delivery.MessageId = event.Message.Id
+	}
+	c.addDelivery(delivery)
+	c.UpdateDelivery(delivery)
+
+	return delivery
+}
+
+func (c *Core) addDelivery(delivery *Delivery) {
+	c.Deliveries = append(c.Deliveries, delivery)
+
+	excess := len(c.Deliveries) - MaxDeliveries
+	c.Deliveries = slices.DeleteFunc(c.Deliveries, func(d *Delivery) bool {
+		if excess > 0 && d.State != DeliveryPending {
+			excess--
+			return true
+		}
+		return false
+	})
+}
+
+// UpdateDelivery notifies the listeners and the journal of the changes made
+// to a delivery, such as its attempts and state.
+func (c *Core) UpdateDelivery(delivery *Delivery) {
+	c.publish(&Event{Type: EventDeliveryUpdated, Delivery: delivery})
+}
+
+// restoreDelivery adds or replaces a delivery recorded in the journal. The
+// deliveries of webhooks that are gone are not restored.
+func (c *Core) restoreDelivery(delivery *Delivery) {
+	delivery.Webhook = c.GetWebhook(delivery.WebhookId)
+	if delivery.Webhook == nil {
+		return
+	}
+
+	i := slices.IndexFunc(c.Deliveries, func(d *Delivery) bool {
+		return d.Id == delivery.Id
+	})
+	if i >= 0 {
+		c.Deliveries[i] = delivery
+	} else {
+		c.addDelivery(delivery)
+	}
+}
+
+// AddAttempt records an attempt to send delivery, keeping only the last
+// MaxDeliveryAttempts.
+func (c *Core) AddAttempt(delivery *Delivery, attempt *Attempt) {
+	delivery.AttemptCount++
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	if len(delivery.Attempts) > MaxDeliveryAttempts {
+		delivery.Attempts = delivery.Attempts[len(delivery.Attempts)-MaxDeliveryAttempts:]
+	}
+}
+
+// WebhookDeliveries returns the deliveries of a webhook, from oldest to
+// newest.
+func (c *Core) WebhookDeliveries(id string) []*Delivery {
+	var deliveries []*Delivery
+	for _, delivery := range c.Deliveries {
+		if delivery.Webhook.Id == id {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries
+}
+
+// NextDelivery returns the oldest pending delivery of a webhook, which must be
+// sent before any other to preserve ordering.
+func (c *Core) NextDelivery(id string) *Delivery {
+	for _, delivery := range c.Deliveries {
+		if delivery.Webhook.Id == id && delivery.State == DeliveryPending {
+			return delivery
+		}
+	}
+
+	return nil
+}
+
+// PendingDeliveries counts the deliveries of the webhook with the given id
+// that were not sent yet, or those of every webhook when id is empty.
+func (c *Core) PendingDeliveries(id string) int {
+	pending := 0
+	for _, delivery := range c.Deliveries {
+		if (id == "" || delivery.Webhook.Id == id) && delivery.State == DeliveryPending {
+			pending++
+		}
+	}
+
+	return pending
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -23,6 +24,9 @@ var (
 	user    = flag.String("user", "", "User that is chatting.")
 	peer    = flag.String("peer", "", "Peer to chat with.")
 	port    = flag.String("port", "", "Port to listen for webhooks.")
+	token   = flag.String("token", "", "Chatsim API access token.")
+
+	verifyToken = flag.String("verify-token", "", "Token expected when chatsim verifies the webhook.")
 )
 
 var (
@@ -114,24 +118,19 @@ func (m *Model) View() string {
 func (m *Model) listen() {
 	client := &http.Client{}
 
-	wreq := api.CreateWebhookRequest{
-		URL: "http://localhost:" + *port,
-	}
-	rres, err := client.Post(fmt.Sprintf("%s/%s/webhooks", *chatsim, *user), "text/json", jsonReader(wreq))
-	if err != nil {
-		panic(err)
-	}
+	handler := &http.ServeMux{}
 
-	if rres.StatusCode != http.StatusOK {
-		k, _ := io.ReadAll(rres.Body)
-		log.Printf("Create webhook error (%d): %s", rres.StatusCode, k)
-	}
-	var wres api.CreateWebhookResponse
-	jsonDecode(rres.Body, &wres)
+	handler.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("hub.mode") != "subscribe" || query.Get("hub.verify_token") != *verifyToken {
+			http.Error(w, "Verification failed", http.StatusForbidden)
+			return
+		}
 
-	handler := &http.ServeMux{}
+		w.Write([]byte(query.Get("hub.challenge")))
+	})
 
-	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handler.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
 		var req jsonObject
 		err := json.NewDecoder(r.Body).Decode(&req)
 		if err != nil {
@@ -143,14 +142,17 @@ func (m *Model) listen() {
 		changes := entry["changes"].(jsonArray)
 		change := changes[0].(jsonObject)
 		value := change["value"].(jsonObject)
-		messages := value["messages"].(jsonArray)
+		messages, ok := value["messages"].(jsonArray)
+		if !ok {
+			// Status updates are not shown.
+			return
+		}
 		message := messages[0].(jsonObject)
 		text := message["text"].(jsonObject)
 		body := text["body"].(string)
-		metadata := value["metadata"].(jsonObject)
-		phone_number := metadata["phone_number_id"].(string)
+		from := message["from"].(string)
 
-		if phone_number != *peer {
+		if from != *peer {
 			return
 		}
 
@@ -167,20 +169,41 @@ func (m *Model) listen() {
 		m.activity <- true
 	})
 
-	srv := http.Server{Addr: fmt.Sprintf(":%s", *port), Handler: handler}
-	go func() {
-		<-closeServer
-		srv.Close()
-		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/%s/webhooks/%s", *chatsim, *user, wres.Id), nil)
-		client.Do(req)
-		serverClosed <- true
-	}()
+	// The webhook server must be listening before the webhook is created,
+	// since chatsim verifies the endpoint when registering it.
+	srv := http.Server{Handler: handler}
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%s", *port))
+	if err != nil {
+		log.Fatalf("Failed to listen for webhooks: %v", err)
+	}
+	go srv.Serve(ln)
 
-	srv.ListenAndServe()
+	wreq := api.CreateWebhookRequest{
+		URL:         "http://localhost:" + *port,
+		VerifyToken: *verifyToken,
+	}
+	rres, err := post(client, fmt.Sprintf("%s/%s/webhooks", *chatsim, *user), jsonReader(wreq))
+	if err != nil {
+		panic(err)
+	}
+
+	if rres.StatusCode != http.StatusOK {
+		k, _ := io.ReadAll(rres.Body)
+		log.Printf("Create webhook error (%d): %s", rres.StatusCode, k)
+	}
+	var wres api.CreateWebhookResponse
+	jsonDecode(rres.Body, &wres)
+
+	<-closeServer
+	srv.Close()
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/%s/webhooks/%s", *chatsim, *user, wres.Id), nil)
+	authorize(req)
+	client.Do(req)
+	serverClosed <- true
 }
 
 func (m *Model) sendMessage(text string) {
-	client := http.Client{}
+	client := &http.Client{}
 	msg := &core.Message{
 		To:   *peer,
 		From: *user,
@@ -188,7 +211,8 @@ func (m *Model) sendMessage(text string) {
 		Text: &core.TextMessage{Body: text},
 	}
 
-	_, err := client.Post(fmt.Sprintf("%s/%s/messages", *chatsim, *user), *chatsim, jsonReader(msg))
+	req := api.CreateMessageRequest{MessagingProduct: "whatsapp", Message: msg}
+	_, err := post(client, fmt.Sprintf("%s/%s/messages", *chatsim, *user), jsonReader(req))
 	if err != nil {
 		log.Printf("Error sending message: %v", err)
 	}
@@ -199,6 +223,23 @@ func (m *Model) sendMessage(text string) {
 	m.activity <- true
 }
 
+func post(client *http.Client, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authorize(req)
+
+	return client.Do(req)
+}
+
+func authorize(req *http.Request) {
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+}
+
 func jsonReader(val any) io.Reader {
 	// log.Printf("Reading json: %T", val)
 	b, err := json.Marshal(val)
@@ -2,17 +2,19 @@ module github.com/andfenastari/chatsim
 
 go 1.23.5
 
-require github.com/andfenastari/templatemap v0.0.0-20210220154937-a5a5ec0e9e01
+require (
+	github.com/andfenastari/templatemap v0.0.0-20210220154937-a5a5ec0e9e01
+	github.com/charmbracelet/bubbletea v1.2.4
+	github.com/davecgh/go-spew v1.1.1
+	github.com/google/uuid v1.6.0
+)
 
 require (
 	github.com/aymanbagabas/go-osc52/v2 v2.0.1 // indirect
-	github.com/charmbracelet/bubbletea v1.2.4 // indirect
 	github.com/charmbracelet/lipgloss v1.0.0 // indirect
 	github.com/charmbracelet/x/ansi v0.4.5 // indirect
 	github.com/charmbracelet/x/term v0.2.1 // indirect
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/erikgeiser/coninput v0.0.0-20211004153227-1c3628e74d0f // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-localereader v0.0.1 // indirect
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"strings"
+	"net"
+	"sync"
+	"syscall"
+	"time"
 
 	//	"io/fs"
 
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 
 	"github.com/andfenastari/chatsim/core"
 	"github.com/andfenastari/chatsim/shell/api"
@@ -20,76 +25,234 @@ import (
 )
 
 var (
-	apiAddr = flag.String("api-addr", ":8000", "API server address.")
-	webAddr = flag.String("web-addr", ":8001", "Web interface server address.")
-
-	snapshotPath = flag.String("snapshot", "", "Path of the snapshot to load")
-	user         = flag.String("user", "agent", "Web server user.")
-
-	devel    = flag.Bool("devel", false, "Turn on development mode.")
-	webhooks = flag.String("webhooks", "", "A comma separated list of '<user>:<url>' values to send webhooks to. Example: 'agent:localhost:900,other:localhost:9001'")
+	config     = DefaultConfig()
+	configPath = flag.String("config", "", "Path of a JSON configuration file. Flags override the values of the file.")
 )
 
+func init() {
+	config.Flags(flag.CommandLine)
+}
+
 func main() {
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		commands[os.Args[1]](os.Args[2:])
+		return
+	}
+
 	flag.CommandLine.Usage = usage
 	flag.Parse()
 
-	if *snapshotPath == "" {
-		die("error: no 'snapshot' provided.\n")
+	// The flags are parsed again on top of the file, so that they override
+	// its values, and the result is only validated then.
+	var file *ConfigFile
+	var errs []*ConfigError
+	if *configPath != "" {
+		config = DefaultConfig()
+		file, errs = ReadConfig(*configPath, &config)
+		flag.Parse()
+	}
+	if *configPath == "" || file != nil {
+		errs = append(errs, file.Locate(config.Validate(), flag.CommandLine)...)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		if *configPath == "" {
+			usage()
+		}
+		os.Exit(1)
 	}
 
-	var hooks []*api.Webhook
-	if *webhooks != "" {
-		for _, spec := range strings.Split(*webhooks, ",") {
-			user, rawUrl, found := strings.Cut(spec, ":")
-			if !found {
-				die("Failed to parse webhook '%s'", spec)
-			}
+	var hooks []*core.Webhook
+	for _, hook := range config.Webhooks {
+		webhook := &core.Webhook{
+			User:         hook.User,
+			URL:          hook.URL,
+			VerifyToken:  cmp.Or(hook.VerifyToken, config.VerifyToken),
+			AppSecret:    cmp.Or(hook.AppSecret, config.AppSecret),
+			BadSignature: hook.BadSignature || config.Faults.BadSignature,
+		}
+		hooks = append(hooks, webhook)
+	}
 
-			parsedUrl, err := url.Parse(rawUrl)
-			if err != nil {
-				die("Failed to parse url '%s': %v", rawUrl, err)
+	mediaDir := config.MediaDir
+	if mediaDir == "" {
+		mediaDir = core.SnapshotBase(config.Snapshot) + ".media"
+	}
+	mediaStore := &core.DirMediaStore{Dir: mediaDir}
+	core.LegacyOwner = config.User
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	core := core.NewCore(ctx)
+	core.MediaStore = mediaStore
+	core.HistorySize = config.History
+	core.SnapshotPath = config.Snapshot
+	core.StaticPhoneNumbers = config.PhoneNumbers
+	core.StaticAccessTokens = config.Tokens
+	core.StaticBusinessAccounts = config.BusinessAccounts
+	if err := core.LoadSnapshot(config.Snapshot); err != nil {
+		log.Print(err)
+		core.Reset()
+	}
+
+	if config.Journal != "" {
+		core.Lock()
+		err := core.OpenJournal(config.Journal)
+		core.Unlock()
+		if err != nil {
+			die("%v\n", err)
+		}
+
+		go func() {
+			ticker := time.NewTicker(time.Duration(config.CompactInterval))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+
+				core.Lock()
+				if err := core.Compact(); err != nil {
+					log.Print(err)
+				}
+				core.Unlock()
 			}
+		}()
+	}
+
+	core.Lock()
+	for _, user := range config.Users {
+		core.GetOrCreateChat([2]string{config.User, user})
+	}
+	core.Unlock()
 
-			hooks = append(hooks, &api.Webhook{User: user, URL: parsedUrl})
+	if config.Watch > 0 {
+		go core.WatchSnapshot(ctx, time.Duration(config.Watch))
+	}
+
+	// The webhooks restored by the journal keep their deliveries, so they
+	// are not registered again, only updated with the configuration.
+	core.Lock()
+	registered := hooks[:0]
+	for _, hook := range hooks {
+		if restored := core.FindWebhook(hook.User, hook.URL); restored != nil {
+			restored.VerifyToken = hook.VerifyToken
+			restored.AppSecret = hook.AppSecret
+			restored.BadSignature = hook.BadSignature
+			continue
 		}
+		registered = append(registered, hook)
 	}
+	hooks = registered
+	core.Unlock()
 
-	ctx := context.Background()
-	core := core.NewCore(ctx)
-	if err := core.LoadSnapshot(*snapshotPath); err != nil {
-		log.Print(err)
+	apiHandler := api.NewHandler(core)
+	apiHandler.Retry = api.RetryPolicy{
+		InitialBackoff: time.Duration(config.WebhookRetry.InitialBackoff),
+		MaxBackoff:     time.Duration(config.WebhookRetry.MaxBackoff),
+		MaxAge:         time.Duration(config.WebhookRetry.MaxAge),
+	}
+	apiHandler.Timeout = time.Duration(config.WebhookTimeout)
+	apiHandler.QueueSize = config.WebhookQueue
+	apiHandler.AdminToken = config.AdminToken
+	apiHandler.Faults = api.Faults{
+		Delay:              time.Duration(config.Faults.Delay),
+		FailureRate:        config.Faults.FailureRate,
+		MessageFailureRate: config.Faults.MessageFailureRate,
+	}
+	apiServer := &http.Server{Addr: config.APIAddr, Handler: apiHandler}
+
+	// The event streams of the web server never finish on their own, so
+	// the requests of the web server are cancelled when shutting down.
+	webCtx, cancelWeb := context.WithCancel(ctx)
+	webServer := &http.Server{
+		Addr:        config.WebAddr,
+		Handler:     web.NewHandler(core, config.User, config.Devel),
+		BaseContext: func(net.Listener) context.Context { return webCtx },
 	}
 
-	fmt.Printf("Starting api server at %s\n", *apiAddr)
-	fmt.Printf("Starting web server at %s\n", *webAddr)
+	fmt.Printf("Starting api server at %s\n", config.APIAddr)
+	fmt.Printf("Starting web server at %s\n", config.WebAddr)
+
+	go serve("API", apiServer)
+	go serve("Web", webServer)
+
+	// Receivers may take a while to answer the verification, or call the
+	// API while verifying, so the servers do not wait for the webhooks.
+	for _, hook := range hooks {
+		go func() {
+			_, err := apiHandler.RegisterWebhook(ctx, hook)
+			if err != nil {
+				log.Printf("Webhook for %s not registered: %v", hook.User, err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Received %v, shutting down", <-signals)
 
 	go func() {
-		handler := api.NewHandler(core)
-		for _, hook := range hooks {
-			handler.RegisterWebhook(hook.User, hook.URL)
-		}
-		server := http.Server{Addr: *apiAddr, Handler: handler}
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("API server failed: %v", err)
-		}
+		<-signals
+		log.Print("Received a second signal, exiting immediately")
+		os.Exit(1)
 	}()
 
-	go func() {
-		handler := web.NewHandler(core, *user, *devel, *snapshotPath)
-		server := http.Server{Addr: *webAddr, Handler: handler}
-		server.ListenAndServe()
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("Web server failed: %v", err)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancelShutdown()
+
+	cancelWeb()
+	var wg sync.WaitGroup
+	for _, server := range []*http.Server{apiServer, webServer} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Failed to shut down server at %s: %v", server.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No new events are published once the servers are shut down.
+	if pending := apiHandler.Drain(shutdownCtx); pending > 0 {
+		log.Printf("Gave up on %d pending webhook deliveries", pending)
+	}
+
+	core.Lock()
+	if config.Journal != "" {
+		if err := core.CloseJournal(); err != nil {
+			log.Print(err)
 		}
-	}()
+	} else if config.SaveOnExit {
+		if err := core.SaveSnapshot(core.SnapshotPath); err != nil {
+			log.Print(err)
+		}
+	}
+	core.Unlock()
+
+	// Cancelling the core closes the listeners, which stops the webhook
+	// workers and the remaining event streams.
+	cancel()
+	log.Print("Shut down")
+}
 
-	for {
+// serve runs server until it is shut down.
+func serve(name string, server *http.Server) {
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%s server failed: %v", name, err)
 	}
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "USAGE: %s [flag]...\nAvailable flags:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "USAGE: %s [flag]...\n       %s snapshot migrate [flag]... <snapshot>...\n       %s config validate <config>...\nAvailable flags:\n", os.Args[0], os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// AdminResponse is the response of the admin endpoints, describing the state
+// once replaced.
+type AdminResponse struct {
+	Success  bool `json:"success"`
+	Chats    int  `json:"chats"`
+	Media    int  `json:"media"`
+	Webhooks int  `json:"webhooks"`
+}
+
+// handleAdminReset empties the state, like POST /snapshot/reset, for test
+// suites that need a clean state before each test case.
+func (s *Handler) handleAdminReset(w http.ResponseWriter, r *http.Request) {
+	s.replaceState(w, r, s.Core.Reset)
+}
+
+// handleAdminSeed replaces the state with the snapshot in the request body,
+// in the format of the format query parameter, JSON by default. The business
+// accounts, phone numbers and access tokens are kept unless the snapshot has
+// its own, so that seeding does not lock clients out. Only the admin token
+// can seed, so only an admin can replace the access tokens.
+func (s *Handler) handleAdminSeed(w http.ResponseWriter, r *http.Request) {
+	format := core.FormatJSON
+	if r.URL.Query().Has("format") {
+		format = core.SnapshotFormat(r.URL.Query().Get("format"))
+	}
+
+	if !slices.Contains(core.SnapshotFormats, format) {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Unsupported snapshot format '%s'.", format))
+		return
+	}
+
+	snapshot, err := s.Core.ReadSnapshot(r.Body, format)
+	if err != nil {
+		log.Printf("Failed to read seed snapshot: %v", err)
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Invalid snapshot: %v", err))
+		return
+	}
+
+	s.replaceState(w, r, func() {
+		if snapshot.PhoneNumbers == nil {
+			snapshot.PhoneNumbers = s.Core.PhoneNumbers
+		}
+		if snapshot.AccessTokens == nil {
+			snapshot.AccessTokens = s.Core.AccessTokens
+		}
+		if snapshot.BusinessAccounts == nil {
+			snapshot.BusinessAccounts = s.Core.BusinessAccounts
+		}
+
+		s.Core.SetSnapshot(snapshot)
+	})
+}
+
+// replaceState replaces the state of the core with replace and, when the
+// clear_webhooks query parameter is set, unregisters every webhook at once.
+// The pending deliveries refer to the previous state, so they are discarded.
+// The response is only sent once the listeners were notified of the new
+// state.
+func (s *Handler) replaceState(w http.ResponseWriter, r *http.Request, replace func()) {
+	clearWebhooks := false
+	if r.URL.Query().Has("clear_webhooks") {
+		var err error
+		clearWebhooks, err = strconv.ParseBool(r.URL.Query().Get("clear_webhooks"))
+		if err != nil {
+			s.messageError(w, core.NewError(core.ErrInvalidParameter, "The parameter clear_webhooks must be a boolean."))
+			return
+		}
+	}
+
+	s.Core.Lock()
+	replace()
+	s.Core.DiscardDeliveries()
+	var removed []*core.Webhook
+	if clearWebhooks {
+		removed = s.Core.ClearWebhooks()
+	}
+	res := AdminResponse{
+		Success:  true,
+		Chats:    len(s.Core.Chats),
+		Media:    len(s.Core.Media),
+		Webhooks: len(s.Core.Webhooks),
+	}
+	s.Core.Unlock()
+
+	for _, webhook := range removed {
+		s.stopWorker(webhook.Id)
+	}
+
+	s.Core.Flush()
+
+	log.Printf("Replaced the state: %d chats, %d media, %d webhooks", res.Chats, res.Media, res.Webhooks)
+	s.encodeJSON(w, res)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// authenticated wraps handler so that it requires a valid access token for the
+// {user} or {account} addressed by the request, passed either as a bearer
+// token or as the access_token query parameter. Authentication is only
+// enforced once the core has at least one access token configured, while
+// unknown business numbers and accounts are always rejected.
+func (s *Handler) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.Core.RLock()
+		enabled := len(s.Core.AccessTokens) > 0
+		s.Core.RUnlock()
+
+		if !enabled {
+			if s.exists(r) {
+				handler(w, r)
+			} else {
+				s.objectError(w, r)
+			}
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			token = r.URL.Query().Get("access_token")
+		}
+
+		if token == "" {
+			s.authError(w, http.StatusUnauthorized, GraphError{
+				Message: "An active access token must be used to query information about the current user.",
+				Code:    190,
+			})
+			return
+		}
+
+		s.Core.RLock()
+		accessToken := s.Core.GetAccessToken(token)
+		s.Core.RUnlock()
+
+		if accessToken == nil {
+			log.Printf("Rejected invalid access token")
+			s.authError(w, http.StatusUnauthorized, GraphError{
+				Message: "Invalid OAuth access token - Cannot parse access token",
+				Code:    190,
+			})
+			return
+		}
+
+		if accessToken.Expired() {
+			log.Printf("Rejected expired access token for %s", accessToken.Number)
+			s.authError(w, http.StatusUnauthorized, GraphError{
+				Message: fmt.Sprintf(
+					"Error validating access token: Session has expired on %s. The current time is %s.",
+					accessToken.Expires.Format(time.RFC1123), time.Now().Format(time.RFC1123),
+				),
+				Code:         190,
+				ErrorSubcode: 463,
+			})
+			return
+		}
+
+		if !s.granted(accessToken, r) || !s.exists(r) {
+			log.Printf("Rejected access token of %s for %s", cmp.Or(accessToken.Number, accessToken.AccountId), r.URL.Path)
+			s.objectError(w, r)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// exists reports whether the {user} addressed by r is a business number, and
+// the {account} a business account.
+func (s *Handler) exists(r *http.Request) bool {
+	s.Core.RLock()
+	defer s.Core.RUnlock()
+
+	if user := r.PathValue("user"); user != "" && !s.Core.IsBusinessNumber(s.Core.ResolveNumber(user)) {
+		return false
+	}
+	if account := r.PathValue("account"); account != "" && s.Core.GetBusinessAccount(account) == nil {
+		return false
+	}
+
+	return true
+}
+
+// granted reports whether token grants access to the {user} or {account}
+// addressed by r.
+func (s *Handler) granted(token *core.AccessToken, r *http.Request) bool {
+	s.Core.RLock()
+	defer s.Core.RUnlock()
+
+	if user := r.PathValue("user"); user != "" && !s.Core.Grants(token, s.Core.ResolveNumber(user)) {
+		return false
+	}
+	if account := r.PathValue("account"); account != "" && token.AccountId != account {
+		return false
+	}
+
+	return true
+}
+
+// objectError reports that the object addressed by r does not exist, or can
+// not be accessed with the token given, which the Graph API does not tell
+// apart.
+func (s *Handler) objectError(w http.ResponseWriter, r *http.Request) {
+	s.authError(w, http.StatusBadRequest, GraphError{
+		Message: fmt.Sprintf(
+			"Unsupported %s request. Object with ID '%s' does not exist, cannot be loaded due to missing permissions, or does not support this operation.",
+			strings.ToLower(r.Method), cmp.Or(r.PathValue("user"), r.PathValue("account")),
+		),
+		Code:         100,
+		ErrorSubcode: 33,
+	})
+}
+
+func (s *Handler) authError(w http.ResponseWriter, status int, err GraphError) {
+	err.Type = "OAuthException"
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `OAuth "Facebook Platform" "invalid_token"`)
+	}
+
+	s.graphError(w, status, err)
+}
+
+// adminOnly wraps handler so that it requires the admin token, passed like
+// the access tokens. The routes that replace or expose the whole state are
+// not scoped to a number, so the access tokens of the numbers do not grant
+// access to them. Without an admin token, they are disabled.
+func (s *Handler) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.AdminToken == "" {
+			s.authError(w, http.StatusForbidden, GraphError{
+				Message: "Admin endpoints are disabled, as no admin token is configured.",
+				Code:    200,
+			})
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			token = r.URL.Query().Get("access_token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) != 1 {
+			log.Printf("Rejected admin request to %s", r.URL.Path)
+			s.authError(w, http.StatusUnauthorized, GraphError{
+				Message: "An admin access token must be used for this request.",
+				Code:    190,
+			})
+			return
+		}
+
+		handler(w, r)
+	}
+}
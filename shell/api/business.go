@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+)
+
+// PhoneNumbersResponse is the response of GET /{account}/phone_numbers,
+// listing the phone numbers of a business account.
+type PhoneNumbersResponse struct {
+	Data []PhoneNumberResponse `json:"data"`
+}
+
+type PhoneNumberResponse struct {
+	Id                 string `json:"id"`
+	DisplayPhoneNumber string `json:"display_phone_number"`
+	VerifiedName       string `json:"verified_name"`
+	QualityRating      string `json:"quality_rating"`
+}
+
+func (s *Handler) handleListPhoneNumbers(w http.ResponseWriter, r *http.Request) {
+	account := r.PathValue("account")
+
+	s.Core.RLock()
+	res := PhoneNumbersResponse{Data: []PhoneNumberResponse{}}
+	for _, phone := range s.Core.AccountPhoneNumbers(account) {
+		res.Data = append(res.Data, PhoneNumberResponse{
+			Id:                 phone.Id,
+			DisplayPhoneNumber: phone.Number,
+			VerifiedName:       phone.Name(),
+			QualityRating:      "GREEN",
+		})
+	}
+	s.Core.RUnlock()
+
+	s.encodeJSON(w, res)
+}
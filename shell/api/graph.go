@@ -0,0 +1,109 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// GraphVersions are the Graph API versions accepted as a path prefix, from
+// oldest to newest. Like on Graph, requests to versions older than the oldest
+// one are served as if they used it, while newer versions are rejected.
+var GraphVersions = []string{"v17.0", "v18.0", "v19.0", "v20.0", "v21.0", "v22.0"}
+
+var versionPattern = regexp.MustCompile(`^/v(\d+)\.(\d+)(/.*)$`)
+
+// GraphError is the error object returned by the Graph API, wrapped in an
+// "error" field.
+type GraphError struct {
+	Message      string          `json:"message"`
+	Type         string          `json:"type"`
+	Code         int             `json:"code"`
+	ErrorSubcode int             `json:"error_subcode,omitempty"`
+	ErrorData    *GraphErrorData `json:"error_data,omitempty"`
+	FbtraceId    string          `json:"fbtrace_id"`
+}
+
+type GraphErrorData struct {
+	MessagingProduct string `json:"messaging_product"`
+	Details          string `json:"details"`
+}
+
+// ServeHTTP strips the optional Graph API version prefix from the request path
+// before routing it, so clients can use the same base URL as in production.
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	match := versionPattern.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		s.ServeMux.ServeHTTP(w, r)
+		return
+	}
+
+	version := fmt.Sprintf("v%s.%s", match[1], match[2])
+	if !supportedVersion(version) {
+		log.Printf("Rejected unknown version %s", version)
+		s.graphError(w, http.StatusBadRequest, GraphError{
+			Message: fmt.Sprintf("Unknown path components: %s", match[3]),
+			Type:    "OAuthException",
+			Code:    2500,
+		})
+		return
+	}
+
+	http.StripPrefix("/"+version, &s.ServeMux).ServeHTTP(w, r)
+}
+
+func supportedVersion(version string) bool {
+	if slices.Contains(GraphVersions, version) {
+		return true
+	}
+
+	var major, minor, oldestMajor, oldestMinor int
+	fmt.Sscanf(version, "v%d.%d", &major, &minor)
+	fmt.Sscanf(GraphVersions[0], "v%d.%d", &oldestMajor, &oldestMinor)
+
+	return major < oldestMajor || (major == oldestMajor && minor < oldestMinor)
+}
+
+func (s *Handler) graphError(w http.ResponseWriter, status int, err GraphError) {
+	if err.FbtraceId == "" {
+		err.FbtraceId = newTraceId()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	e := json.NewEncoder(w).Encode(map[string]GraphError{"error": err})
+	if e != nil {
+		log.Printf("Failed to encode error %+v: %v", err, e)
+	}
+}
+
+// messageError reports a Cloud API error, using the "(#code) title" message
+// format of the Graph API.
+func (s *Handler) messageError(w http.ResponseWriter, err *core.Error) {
+	graphErr := GraphError{
+		Message: fmt.Sprintf("(#%d) %s", err.Code, err.Title),
+		Type:    "OAuthException",
+		Code:    err.Code,
+	}
+	if err.ErrorData != nil {
+		graphErr.ErrorData = &GraphErrorData{
+			MessagingProduct: "whatsapp",
+			Details:          err.ErrorData.Details,
+		}
+	}
+
+	s.graphError(w, http.StatusBadRequest, graphErr)
+}
+
+func newTraceId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
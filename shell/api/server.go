@@ -1,70 +1,205 @@
 package api
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 
 	"github.com/andfenastari/chatsim/core"
-	"github.com/google/uuid"
 )
 
 type Handler struct {
 	http.ServeMux
 
-	Core     *core.Core
-	Client   http.Client
-	Webhooks sync.Map
-}
+	Core   *core.Core
+	Client http.Client
+	Retry  RetryPolicy
+	Faults Faults
+
+	// Timeout bounds each webhook request, and QueueSize the number of
+	// pending deliveries of each webhook. Deliveries to a webhook with a full
+	// queue are dropped.
+	Timeout   time.Duration
+	QueueSize int
+
+	// AdminToken grants access to the admin endpoints, which are disabled
+	// when it is empty.
+	AdminToken string
 
-type Webhook struct {
-	User string
-	URL  *url.URL
+	events      *core.Listener
+	workersLock sync.Mutex
+	workers     map[string]*worker
 }
 
 func NewHandler(core *core.Core) *Handler {
 	handler := new(Handler)
 	handler.Core = core
-
-	handler.HandleFunc("POST /{user}/messages", handler.handleCreateMessage)
-	handler.HandleFunc("GET /{user}/messages", handler.handleListMessages)
-	handler.HandleFunc("POST /{user}/webhooks", handler.handleCreateWebhook)
-	handler.HandleFunc("DELETE /{user}/webhooks/{id}", handler.handleDeleteWebhook)
-	handler.HandleFunc("POST /{user}/media", handler.handleCreateMedia)
-	handler.HandleFunc("GET /{media}", handler.handleViewMedia)
-	handler.HandleFunc("GET /{media}/download", handler.handleDownloadMedia)
-
+	handler.Retry = DefaultRetryPolicy
+	handler.Timeout = DefaultTimeout
+	handler.QueueSize = DefaultQueueSize
+	handler.workers = map[string]*worker{}
+
+	handler.HandleFunc("POST /{user}/messages", handler.authenticated(handler.handleCreateMessage))
+	handler.HandleFunc("GET /{user}/messages", handler.authenticated(handler.handleListMessages))
+	handler.HandleFunc("POST /{user}/webhooks", handler.authenticated(handler.handleCreateWebhook))
+	handler.HandleFunc("DELETE /{user}/webhooks/{id}", handler.authenticated(handler.handleDeleteWebhook))
+	handler.HandleFunc("GET /{user}/webhooks/{id}/deliveries", handler.authenticated(handler.handleListDeliveries))
+	handler.HandleFunc("POST /{user}/media", handler.authenticated(handler.handleCreateMedia))
+	handler.HandleFunc("GET /{account}/phone_numbers", handler.authenticated(handler.handleListPhoneNumbers))
+	handler.HandleFunc("GET /snapshot/files", handler.adminOnly(handler.handleListSnapshots))
+	handler.HandleFunc("POST /snapshot/files/{name}/load", handler.adminOnly(handler.handleLoadSnapshot))
+	handler.HandleFunc("POST /snapshot/reload", handler.adminOnly(handler.handleReloadSnapshot))
+	handler.HandleFunc("POST /snapshot/reset", handler.adminOnly(handler.handleResetSnapshot))
+	handler.HandleFunc("GET /snapshot/history", handler.adminOnly(handler.handleListHistory))
+	handler.HandleFunc("POST /snapshot/history/{name}/restore", handler.adminOnly(handler.handleRestoreSnapshot))
+	handler.HandleFunc("POST /_admin/reset", handler.adminOnly(handler.handleAdminReset))
+	handler.HandleFunc("POST /_admin/seed", handler.adminOnly(handler.handleAdminSeed))
+	handler.HandleFunc("GET /{media}", handler.authenticated(handler.handleViewMedia))
+	handler.HandleFunc("GET /{media}/download", handler.authenticated(handler.handleDownloadMedia))
+
+	// The listener is added right away, so that no event published once the
+	// handler is created is missed. The events published before are flushed
+	// first, as replacing the state while the core was set up must not
+	// discard the deliveries restored from the journal.
+	core.Flush()
+	handler.events = core.AddListener(webhookListenerOptions)
 	go handler.notifyWebhooks()
 
+	// Webhooks restored from the journal resume their pending deliveries.
+	core.RLock()
+	for _, webhook := range core.Webhooks {
+		handler.startWorker(webhook)
+	}
+	core.RUnlock()
+
 	return handler
 }
 
+// CreateMessageRequest is the body of POST /{user}/messages. Besides sending
+// messages, the Cloud API uses the same endpoint to mark received messages as
+// read, in which case only Status and MessageId are set.
+type CreateMessageRequest struct {
+	*core.Message
+	MessagingProduct string `json:"messaging_product"`
+	RecipientType    string `json:"recipient_type,omitempty"`
+	Status           string `json:"status,omitempty"`
+	MessageId        string `json:"message_id,omitempty"`
+}
+
 func (s *Handler) handleCreateMessage(w http.ResponseWriter, r *http.Request) {
-	user := r.PathValue("user")
+	user := s.user(r)
+
+	var req CreateMessageRequest
+	if s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.MessagingProduct != "whatsapp" {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "The parameter messaging_product is required and must be 'whatsapp'."))
+		return
+	}
 
-	var msg *core.Message
-	if s.decodeJSON(w, r, &msg) {
+	if req.Status != "" {
+		s.markRead(w, user, &req)
 		return
 	}
 
-	msg.From = user
+	msg := req.Message
+	if msg == nil {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "The parameter to is required."))
+		return
+	}
+	if msg.Type == "" {
+		msg.Type = "text"
+	}
+	msg.Id, msg.Timestamp, msg.From = "", 0, user
 
 	log.Printf("Received message: %+v", msg)
 
 	s.Core.Lock()
-	defer s.Core.Unlock()
-
+	if err := s.Core.ValidateMessage(msg); err != nil {
+		s.Core.Unlock()
+		log.Printf("Rejected message: %s", err.ErrorData.Details)
+		s.messageError(w, err)
+		return
+	}
 	chat := s.Core.GetOrCreateChat([2]string{msg.From, msg.To})
 	s.Core.AddMessage(chat, msg)
+	if rand.Float64() < s.Faults.MessageFailureRate {
+		err := s.Core.UpdateStatus(msg, core.StatusFailed, core.NewError(core.ErrUndeliverable, "Injected failure."))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	s.Core.Unlock()
+
+	s.encodeJSON(w, newCreateMessageResponse(msg))
+}
+
+type CreateMessageResponse struct {
+	MessagingProduct string           `json:"messaging_product"`
+	Contacts         []Contact        `json:"contacts"`
+	Messages         []CreatedMessage `json:"messages"`
+}
+
+type Contact struct {
+	Input string `json:"input"`
+	WaId  string `json:"wa_id"`
+}
+
+type CreatedMessage struct {
+	Id string `json:"id"`
+}
+
+func newCreateMessageResponse(msg *core.Message) CreateMessageResponse {
+	return CreateMessageResponse{
+		MessagingProduct: "whatsapp",
+		Contacts:         []Contact{{Input: msg.To, WaId: msg.To}},
+		Messages:         []CreatedMessage{{Id: msg.Id}},
+	}
+}
+
+type MarkReadResponse struct {
+	Success bool `json:"success"`
+}
+
+func (s *Handler) markRead(w http.ResponseWriter, user string, req *CreateMessageRequest) {
+	if req.Status != core.StatusRead {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Param status must be 'read'."))
+		return
+	}
+
+	s.Core.Lock()
+	defer s.Core.Unlock()
+
+	msg := s.Core.GetMessage(req.MessageId)
+	if msg == nil || msg.To != user {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Unknown message_id '%s'.", req.MessageId))
+		return
+	}
+
+	log.Printf("Marking message as read: %s", msg.Id)
+
+	if msg.Status != core.StatusRead {
+		err := s.Core.MarkRead(msg)
+		if err != nil {
+			log.Print(err)
+			s.messageError(w, core.NewError(core.ErrInvalidValue, "Message '%s' can not be marked as read.", msg.Id))
+			return
+		}
+	}
+
+	s.encodeJSON(w, MarkReadResponse{Success: true})
 }
 
 func (s *Handler) handleListMessages(w http.ResponseWriter, r *http.Request) {
-	user := r.PathValue("user")
+	user := s.user(r)
 	peer := r.FormValue("peer")
 
 	if peer == "" {
@@ -83,7 +218,10 @@ func (s *Handler) handleListMessages(w http.ResponseWriter, r *http.Request) {
 }
 
 type CreateWebhookRequest struct {
-	URL string `json:"url"`
+	URL          string `json:"url"`
+	VerifyToken  string `json:"verify_token"`
+	AppSecret    string `json:"app_secret"`
+	BadSignature bool   `json:"bad_signature"`
 }
 
 type CreateWebhookResponse struct {
@@ -91,7 +229,7 @@ type CreateWebhookResponse struct {
 }
 
 func (s *Handler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
-	user := r.PathValue("user")
+	user := s.user(r)
 
 	var req CreateWebhookRequest
 	if s.decodeJSON(w, r, &req) {
@@ -102,32 +240,62 @@ func (s *Handler) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
 
 	url, err := url.Parse(req.URL)
 	if err != nil {
-		log.Print("Failed to decode url: %v", err)
-		http.Error(w, "Invalid request url", http.StatusBadRequest)
+		log.Printf("Failed to decode url: %v", err)
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Invalid url '%s'.", req.URL))
 		return
 	}
 
-	id := s.RegisterWebhook(user, url)
+	id, err := s.RegisterWebhook(r.Context(), &core.Webhook{
+		User:         user,
+		URL:          url.String(),
+		VerifyToken:  req.VerifyToken,
+		AppSecret:    req.AppSecret,
+		BadSignature: req.BadSignature,
+	})
+	if err != nil {
+		log.Print(err)
+		s.graphError(w, http.StatusBadRequest, GraphError{
+			Message: fmt.Sprintf("(#2200) Callback verification failed with the following errors: %v", err),
+			Type:    "OAuthException",
+			Code:    2200,
+		})
+		return
+	}
 
 	s.encodeJSON(w, CreateWebhookResponse{Id: id})
 }
 
-func (s *Handler) RegisterWebhook(user string, url *url.URL) string {
-	id := uuid.NewString()
-	s.Webhooks.Store(id, Webhook{
-		URL:  url,
-		User: user,
-	})
+func (s *Handler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	log.Printf("Deleted webhook: %+v", id)
+
+	s.Core.Lock()
+	s.Core.RemoveWebhook(id)
+	s.Core.Unlock()
 
-	return id
+	s.stopWorker(id)
 }
 
-func (s *Handler) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+func (s *Handler) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	user := s.user(r)
 	id := r.PathValue("id")
 
-	log.Printf("Deleted webhook: %+v", id)
+	s.Core.RLock()
+	defer s.Core.RUnlock()
 
-	s.Webhooks.Delete(id)
+	webhook := s.Core.GetWebhook(id)
+	if webhook == nil || webhook.User != user {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Unknown webhook '%s'.", id))
+		return
+	}
+
+	deliveries := s.Core.WebhookDeliveries(id)
+	if deliveries == nil {
+		deliveries = []*core.Delivery{}
+	}
+
+	s.encodeJSON(w, deliveries)
 }
 
 type CreateMediaResponse struct {
@@ -135,7 +303,7 @@ type CreateMediaResponse struct {
 }
 
 func (s *Handler) handleCreateMedia(w http.ResponseWriter, r *http.Request) {
-	user := r.PathValue("user")
+	user := s.user(r)
 
 	r.ParseMultipartForm(1_000)
 	typ := r.MultipartForm.Value["type"][0]
@@ -153,9 +321,15 @@ func (s *Handler) handleCreateMedia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Core.Lock()
-	id := s.Core.AddMedia(user, typ, data)
+	id, err := s.Core.AddMedia(user, typ, data)
 	s.Core.Unlock()
 
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Internal handler error", http.StatusInternalServerError)
+		return
+	}
+
 	s.encodeJSON(w, CreateMediaResponse{Id: id})
 }
 
@@ -164,7 +338,7 @@ type ViewMediaResponse struct {
 	URL              string `json:"url"`
 	Sha256           []byte `json:"sha256"`
 	MimeType         string `json:"mime_type"`
-	FileSize         int    `json:"file_size"`
+	FileSize         int64  `json:"file_size"`
 	Id               string `json:"id"`
 }
 
@@ -188,7 +362,7 @@ func (s *Handler) handleViewMedia(w http.ResponseWriter, r *http.Request) {
 		URL:              fmt.Sprintf("http://localhost:8000/%s/download", mediaId), // TODO: Un-fake url
 		Sha256:           media.Hash,
 		MimeType:         media.ContentType(),
-		FileSize:         len(media.Data),
+		FileSize:         media.Size,
 		Id:               media.Id,
 	})
 }
@@ -200,67 +374,41 @@ func (s *Handler) handleDownloadMedia(w http.ResponseWriter, r *http.Request) {
 	media := s.Core.GetMedia(mediaId)
 	s.Core.RUnlock()
 
+	if media == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := s.Core.OpenMedia(media)
+	if err != nil {
+		log.Printf("Failed to open media '%s': %v", mediaId, err)
+		http.Error(w, "Internal handler error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	// ServeContent handles Range requests, so large media can be fetched
+	// in parts and downloads can be resumed.
 	w.Header().Set("Content-Type", media.ContentType())
-	w.Write(media.Data)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, media.Hash))
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
-type jsonObject = map[string]interface{}
-type jsonArray = []interface{}
-
-func (s *Handler) notifyWebhooks() {
-	events := s.Core.AddListener()
-
-	for event := range events {
-		s.Webhooks.Range(func(key, val any) bool {
-			id := key.(string)
-			webhook := val.(Webhook)
-
-			if webhook.User != event.To {
-				return true
-			}
-
-			body := jsonObject{
-				"object": "whatsapp_business_account",
-				"entry": jsonArray{
-					jsonObject{
-						"id": event.To,
-						"changes": jsonArray{
-							jsonObject{
-								"field": "messages",
-								"value": jsonObject{
-									"messaging_product": "whatsapp",
-									"metadata": jsonObject{
-										"display_phone_number": event.From,
-										"phone_number_id":      event.From,
-									},
-									"messages": jsonArray{event},
-								},
-							},
-						},
-					},
-				},
-			}
-
-			bodyBytes, _ := json.Marshal(body)
-			bodyReader := bytes.NewReader(bodyBytes)
-			_, err := s.Client.Post(webhook.URL.String(), "application/json", bodyReader)
-			if err != nil {
-				log.Printf("Failed to send webhook %s to %s: %v", id, webhook.User, err)
-			}
-
-			log.Printf("Sent webhook: %+v", body)
-
-			return true
-		})
-	}
+// user returns the simulated number addressed by the request's {user} path
+// segment, which may be either the number itself or its phone number id.
+func (s *Handler) user(r *http.Request) string {
+	s.Core.RLock()
+	defer s.Core.RUnlock()
+
+	return s.Core.ResolveNumber(r.PathValue("user"))
 }
 
 func (s *Handler) decodeJSON(w http.ResponseWriter, r *http.Request, val any) (failed bool) {
 	log.Printf("Decoding %T", val)
 	err := json.NewDecoder(r.Body).Decode(val)
 	if err != nil {
-		log.Print("Failed to decode body %T: %v", val, err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		log.Printf("Failed to decode body %T: %v", val, err)
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Invalid request body: %v", err))
 		return true
 	}
 
@@ -271,7 +419,7 @@ func (s *Handler) encodeJSON(w http.ResponseWriter, val any) (failed bool) {
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(val)
 	if err != nil {
-		log.Print("Failed to encode response %T: %v", val, err)
+		log.Printf("Failed to encode response %T: %v", val, err)
 		http.Error(w, "Internal handler error", http.StatusInternalServerError)
 		return true
 	}
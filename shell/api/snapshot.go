@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// SnapshotResponse is the response of the requests replacing the state,
+// naming the snapshot the state is saved to from then on.
+type SnapshotResponse struct {
+	Success  bool   `json:"success"`
+	Snapshot string `json:"snapshot"`
+}
+
+// handleListSnapshots lists the snapshots next to the current one, which can
+// be loaded in its place.
+func (s *Handler) handleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	s.Core.RLock()
+	files, err := s.Core.SnapshotFiles()
+	s.Core.RUnlock()
+
+	s.encodeSnapshotFiles(w, files, err)
+}
+
+// handleListHistory lists the previous versions of the snapshot, from newest
+// to oldest.
+func (s *Handler) handleListHistory(w http.ResponseWriter, r *http.Request) {
+	s.Core.RLock()
+	files, err := s.Core.SnapshotHistory(s.Core.SnapshotPath)
+	s.Core.RUnlock()
+
+	s.encodeSnapshotFiles(w, files, err)
+}
+
+func (s *Handler) encodeSnapshotFiles(w http.ResponseWriter, files []*core.SnapshotFile, err error) {
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Internal handler error", http.StatusInternalServerError)
+		return
+	}
+
+	if files == nil {
+		files = []*core.SnapshotFile{}
+	}
+
+	s.encodeJSON(w, files)
+}
+
+// handleLoadSnapshot switches to another snapshot next to the current one.
+func (s *Handler) handleLoadSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	s.Core.Lock()
+	err := s.Core.SwitchSnapshot(name)
+	path := s.Core.SnapshotPath
+	s.Core.Unlock()
+
+	s.snapshotResponse(w, name, path, err)
+}
+
+// handleReloadSnapshot reloads the current snapshot, discarding the unsaved
+// changes.
+func (s *Handler) handleReloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.Core.Lock()
+	err := s.Core.ReloadSnapshot()
+	path := s.Core.SnapshotPath
+	s.Core.Unlock()
+
+	s.snapshotResponse(w, path, path, err)
+}
+
+// handleResetSnapshot empties the state, keeping the registered webhooks.
+func (s *Handler) handleResetSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.Core.Lock()
+	s.Core.Reset()
+	path := s.Core.SnapshotPath
+	s.Core.Unlock()
+
+	s.encodeJSON(w, SnapshotResponse{Success: true, Snapshot: path})
+}
+
+// handleRestoreSnapshot replaces the state with a previous version of the
+// snapshot. The snapshot file itself is only replaced once saved.
+func (s *Handler) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	s.Core.Lock()
+	err := s.Core.RestoreSnapshot(s.Core.SnapshotPath, name)
+	path := s.Core.SnapshotPath
+	s.Core.Unlock()
+
+	s.snapshotResponse(w, name, path, err)
+}
+
+func (s *Handler) snapshotResponse(w http.ResponseWriter, name, path string, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Unknown snapshot '%s'.", name))
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load snapshot '%s': %v", name, err)
+		s.messageError(w, core.NewError(core.ErrInvalidParameter, "Snapshot '%s' can not be loaded: %v", name, err))
+		return
+	}
+
+	log.Printf("Loaded snapshot '%s'", name)
+	s.encodeJSON(w, SnapshotResponse{Success: true, Snapshot: path})
+}
@@ -0,0 +1,481 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// RetryPolicy configures how failed webhook deliveries are retried. The delay
+// between attempts starts at InitialBackoff and doubles after each failure, up
+// to MaxBackoff. Deliveries older than MaxAge are not retried anymore.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAge         time.Duration
+}
+
+// Faults injects failures into webhook deliveries and messages, to exercise
+// the retry, deduplication and failure handling of clients. The zero value
+// injects none.
+type Faults struct {
+	// Delay is waited before each delivery attempt.
+	Delay time.Duration
+
+	// FailureRate is the probability, between 0 and 1, of an attempt failing
+	// without being sent.
+	FailureRate float64
+
+	// MessageFailureRate is the probability, between 0 and 1, of a message
+	// sent through the API failing once sent, as if it could not reach the
+	// recipient's phone.
+	MessageFailureRate float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     15 * time.Minute,
+	MaxAge:         24 * time.Hour,
+}
+
+const (
+	DefaultTimeout   = 10 * time.Second
+	DefaultQueueSize = 1000
+)
+
+// Backoff returns the delay before the next attempt of a delivery that failed
+// the given number of times.
+func (p RetryPolicy) Backoff(failures int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < failures && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, p.MaxBackoff)
+}
+
+// RegisterWebhook verifies the webhook endpoint like Meta does when a callback
+// URL is configured, and only starts sending events to it if the endpoint
+// echoes the verification challenge back. The verification is bounded by ctx
+// and the Timeout of the webhook requests.
+func (s *Handler) RegisterWebhook(ctx context.Context, webhook *core.Webhook) (string, error) {
+	err := s.verifyWebhook(ctx, webhook)
+	if err != nil {
+		return "", fmt.Errorf("Failed to verify webhook '%s': %w", webhook.URL, err)
+	}
+
+	s.Core.Lock()
+	id := s.Core.AddWebhook(webhook)
+	s.Core.Unlock()
+
+	s.startWorker(webhook)
+
+	return id, nil
+}
+
+func (s *Handler) verifyWebhook(ctx context.Context, webhook *core.Webhook) error {
+	challenge := strconv.Itoa(rand.IntN(1_000_000_000))
+
+	verifyUrl, err := url.Parse(webhook.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid url: %w", err)
+	}
+	query := verifyUrl.Query()
+	query.Set("hub.mode", "subscribe")
+	query.Set("hub.verify_token", webhook.VerifyToken)
+	query.Set("hub.challenge", challenge)
+	verifyUrl.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", verifyUrl.String(), nil)
+	if err != nil {
+		return fmt.Errorf("Invalid url: %w", err)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Verification request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Verification request returned status %s", res.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("Failed to read verification response: %w", err)
+	}
+
+	if strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("Verification response '%s' does not match the challenge '%s'", body, challenge)
+	}
+
+	return nil
+}
+
+// sign returns the X-Hub-Signature-256 header value of body, or an empty
+// string when the webhook has no app secret.
+func sign(webhook *core.Webhook, body []byte) string {
+	if webhook.AppSecret == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(webhook.AppSecret))
+	mac.Write(body)
+	sum := mac.Sum(nil)
+	if webhook.BadSignature {
+		sum[0] ^= 0xff
+	}
+
+	return "sha256=" + hex.EncodeToString(sum)
+}
+
+type jsonObject = map[string]interface{}
+type jsonArray = []interface{}
+
+// webhookListenerOptions selects the events sent to webhooks, and those
+// replacing the state, which discard the pending deliveries. Deliveries are
+// persisted by the core as soon as they are queued, so the buffer only needs
+// to absorb bursts of events. Reactions are sent as messages, like in the
+// Cloud API.
+var webhookListenerOptions = core.ListenerOptions{
+	Buffer:   1000,
+	Overflow: core.DropOldest,
+	Filter: core.EventFilter{
+		Types: []core.EventType{
+			core.EventMessageCreated,
+			core.EventStatusChanged,
+			core.EventSnapshotLoaded,
+			core.EventReset,
+		},
+	},
+}
+
+// notifyWebhooks queues a delivery to each of the webhooks interested in an
+// event. The deliveries are sent by the webhook workers, so a slow endpoint
+// can not hold back the listener. The workers are stopped once the core is
+// done.
+func (s *Handler) notifyWebhooks() {
+	defer s.stopWorkers()
+
+	for event := range s.events.C {
+		msg := event.Message
+
+		// Messages are delivered to the recipient's webhooks, while status
+		// changes are reported back to the sender.
+		var user string
+		value := jsonObject{"messaging_product": "whatsapp"}
+		switch event.Type {
+		case core.EventMessageCreated:
+			user = msg.To
+		case core.EventStatusChanged:
+			user = msg.From
+			value["statuses"] = jsonArray{event.Status}
+		case core.EventSnapshotLoaded, core.EventReset:
+			// Events are received in order, so the deliveries discarded are
+			// exactly those queued for the previous state.
+			s.Core.Lock()
+			s.Core.DiscardDeliveries()
+			s.Core.Unlock()
+			continue
+		default:
+			continue
+		}
+
+		s.Core.Lock()
+		// Events queued before the state was replaced refer to messages
+		// that are gone, and must not be delivered after it.
+		if s.Core.GetMessage(msg.Id) != msg {
+			s.Core.Unlock()
+			continue
+		}
+
+		// The status of messages is only reported through statuses, so it
+		// is left out of their copy.
+		if event.Type == core.EventMessageCreated {
+			payload := *msg
+			payload.Status, payload.Error = "", nil
+			value["messages"] = jsonArray{payload}
+		}
+
+		value["metadata"] = jsonObject{
+			"display_phone_number": user,
+			"phone_number_id":      s.Core.PhoneNumberId(user),
+		}
+
+		// Entries are per business account, like in the Cloud API, so
+		// numbers without one stand for their own account.
+		entryId := user
+		if phone := s.Core.GetPhoneNumber(user); phone != nil && phone.AccountId != "" {
+			entryId = phone.AccountId
+		}
+
+		body := jsonObject{
+			"object": "whatsapp_business_account",
+			"entry": jsonArray{
+				jsonObject{
+					"id": entryId,
+					"changes": jsonArray{
+						jsonObject{
+							"field": "messages",
+							"value": value,
+						},
+					},
+				},
+			},
+		}
+		bodyBytes, _ := json.Marshal(body)
+
+		webhooks := s.Core.UserWebhooks(user)
+		for _, webhook := range webhooks {
+			if s.Core.PendingDeliveries(webhook.Id) >= s.QueueSize {
+				log.Printf("Dropped webhook for %s: %d deliveries already pending", webhook.URL, s.QueueSize)
+				delivery := s.Core.AddDelivery(webhook, event, bodyBytes)
+				delivery.State = core.DeliveryFailed
+				s.Core.AddAttempt(delivery, &core.Attempt{Time: time.Now(), Error: "Delivery queue is full"})
+				s.Core.UpdateDelivery(delivery)
+				continue
+			}
+
+			s.Core.AddDelivery(webhook, event, bodyBytes)
+		}
+		s.Core.Unlock()
+
+		for _, webhook := range webhooks {
+			s.wakeWorker(webhook.Id)
+		}
+	}
+}
+
+// Drain waits until the events published so far were sent to the webhooks,
+// or ctx is done, returning the number of deliveries still pending. Failed
+// deliveries are retried as usual while draining, so an endpoint that is down
+// holds Drain back until ctx is done.
+func (s *Handler) Drain(ctx context.Context) int {
+	s.Core.Flush()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	// An event being handled is neither buffered nor a delivery yet, so the
+	// queues must be seen empty twice in a row.
+	idle := 0
+	for {
+		s.Core.RLock()
+		pending := s.Core.PendingDeliveries("")
+		s.Core.RUnlock()
+
+		if pending == 0 && len(s.events.C) == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		if idle == 2 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return pending
+		case <-ticker.C:
+		}
+	}
+}
+
+// worker sends the deliveries of a single webhook in order, so that a slow or
+// failing endpoint only holds back its own deliveries.
+type worker struct {
+	webhook *core.Webhook
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func (s *Handler) startWorker(webhook *core.Webhook) {
+	w := &worker{
+		webhook: webhook,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	s.workersLock.Lock()
+	s.workers[webhook.Id] = w
+	s.workersLock.Unlock()
+
+	go s.runWorker(w)
+}
+
+func (s *Handler) stopWorker(id string) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	if w, ok := s.workers[id]; ok {
+		close(w.done)
+		delete(s.workers, id)
+	}
+}
+
+func (s *Handler) stopWorkers() {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	for id, w := range s.workers {
+		close(w.done)
+		delete(s.workers, id)
+	}
+}
+
+func (s *Handler) wakeWorker(id string) {
+	s.workersLock.Lock()
+	defer s.workersLock.Unlock()
+
+	w, ok := s.workers[id]
+	if !ok {
+		return
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runWorker sends the pending deliveries of a webhook as they become due. A
+// failing delivery holds back the ones queued after it until it is delivered
+// or given up on.
+func (s *Handler) runWorker(w *worker) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+
+		for {
+			s.Core.RLock()
+			delivery := s.Core.NextDelivery(w.webhook.Id)
+			s.Core.RUnlock()
+
+			if delivery == nil {
+				break
+			}
+
+			if wait := time.Until(delivery.NextAttempt); wait > 0 {
+				timer.Reset(wait)
+				break
+			}
+
+			s.attempt(delivery)
+
+			select {
+			case <-w.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// attempt sends a delivery once, scheduling a retry if it fails.
+func (s *Handler) attempt(delivery *core.Delivery) {
+	attempt := s.send(delivery.Webhook, delivery.Body)
+
+	s.Core.Lock()
+	defer s.Core.Unlock()
+
+	s.Core.AddAttempt(delivery, attempt)
+	defer s.Core.UpdateDelivery(delivery)
+
+	switch {
+	case delivery.State != core.DeliveryPending:
+		// The webhook was removed while sending.
+	case attempt.Succeeded():
+		log.Printf("Delivered webhook %s to %s", delivery.Id, delivery.Webhook.URL)
+		delivery.State = core.DeliveryDelivered
+		if delivery.Type == core.EventMessageCreated {
+			s.markDelivered(s.Core.GetMessage(delivery.MessageId))
+		}
+	case time.Since(delivery.Created) > s.Retry.MaxAge:
+		log.Printf("Giving up on webhook %s to %s after %d attempts", delivery.Id, delivery.Webhook.URL, delivery.AttemptCount)
+		delivery.State = core.DeliveryFailed
+	default:
+		backoff := s.Retry.Backoff(delivery.AttemptCount)
+		log.Printf("Failed to deliver webhook %s to %s, retrying in %v", delivery.Id, delivery.Webhook.URL, backoff)
+		delivery.NextAttempt = time.Now().Add(backoff)
+	}
+}
+
+func (s *Handler) send(webhook *core.Webhook, body []byte) *core.Attempt {
+	attempt := &core.Attempt{Time: time.Now()}
+	defer func() {
+		attempt.Duration = time.Since(attempt.Time)
+	}()
+
+	time.Sleep(s.Faults.Delay)
+	if rand.Float64() < s.Faults.FailureRate {
+		attempt.Error = "Injected failure"
+		return attempt
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature := sign(webhook, body); signature != "" {
+		req.Header.Set("X-Hub-Signature-256", signature)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+
+	response, err := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	attempt.StatusCode = res.StatusCode
+	attempt.Response = string(response)
+
+	return attempt
+}
+
+// markDelivered is called once a message reached one of the recipient's
+// webhooks. The core must be locked by the caller.
+func (s *Handler) markDelivered(msg *core.Message) {
+	if msg == nil || msg.Status != core.StatusSent {
+		return
+	}
+
+	err := s.Core.UpdateStatus(msg, core.StatusDelivered, nil)
+	if err != nil {
+		log.Print(err)
+	}
+}
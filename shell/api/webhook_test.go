@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+type SignTest struct {
+	Webhook   *core.Webhook
+	Body      string
+	Signature string
+}
+
+func TestSign(t *testing.T) {
+	// Test case 2 of RFC 4231.
+	tests := []SignTest{
+		{
+			Webhook:   &core.Webhook{},
+			Body:      "what do ya want for nothing?",
+			Signature: "",
+		},
+		{
+			Webhook:   &core.Webhook{AppSecret: "Jefe"},
+			Body:      "what do ya want for nothing?",
+			Signature: "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		},
+		{
+			Webhook:   &core.Webhook{AppSecret: "Jefe", BadSignature: true},
+			Body:      "what do ya want for nothing?",
+			Signature: "sha256=a4dcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+			signature := sign(test.Webhook, []byte(test.Body))
+			if signature != test.Signature {
+				t.Errorf("Expected signature '%s', got '%s'", test.Signature, signature)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// chatFilter selects the chats of the admin view. A chat matches when a
+// member contains Participant and, when Type or a date is set, it has a
+// message of that type sent between From and To, both inclusive.
+type chatFilter struct {
+	Participant string
+	Type        string
+	From        string
+	To          string
+
+	from, to time.Time
+}
+
+const dateLayout = "2006-01-02"
+
+func parseChatFilter(r *http.Request) (filter chatFilter, err error) {
+	filter = chatFilter{
+		Participant: strings.TrimSpace(r.FormValue("participant")),
+		Type:        r.FormValue("type"),
+		From:        r.FormValue("from"),
+		To:          r.FormValue("to"),
+	}
+
+	if filter.From != "" {
+		filter.from, err = time.ParseInLocation(dateLayout, filter.From, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid date '%s'", filter.From)
+		}
+	}
+	if filter.To != "" {
+		filter.to, err = time.ParseInLocation(dateLayout, filter.To, time.Local)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid date '%s'", filter.To)
+		}
+		filter.to = filter.to.AddDate(0, 0, 1)
+	}
+
+	return filter, nil
+}
+
+func (f chatFilter) matchesMessage(msg *core.Message) bool {
+	sent := time.Unix(msg.Timestamp, 0)
+	return (f.Type == "" || msg.Type == f.Type) &&
+		(f.from.IsZero() || !sent.Before(f.from)) &&
+		(f.to.IsZero() || sent.Before(f.to))
+}
+
+// matches returns whether chat matches the filter, and the number of its
+// messages that do.
+func (f chatFilter) matches(chat *core.Chat) (bool, int) {
+	if f.Participant != "" && !strings.Contains(chat.Members[0], f.Participant) && !strings.Contains(chat.Members[1], f.Participant) {
+		return false, 0
+	}
+
+	count := 0
+	for _, msg := range chat.Messages {
+		if f.matchesMessage(msg) {
+			count++
+		}
+	}
+
+	filtered := f.Type != "" || f.From != "" || f.To != ""
+	return !filtered || count > 0, count
+}
+
+type adminChat struct {
+	Members  [2]string
+	URL      string
+	Messages int
+	Matching int
+	Last     time.Time
+}
+
+type adminChatsPage struct {
+	Filter chatFilter
+	Types  []string
+	Chats  []adminChat
+}
+
+// handleAdminChats lists every chat of the core, regardless of the business
+// numbers and customers, for operators debugging a conversation.
+func (s *Handler) handleAdminChats(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseChatFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := adminChatsPage{Filter: filter}
+
+	s.Core.RLock()
+	for _, chat := range s.Core.Chats {
+		for _, msg := range chat.Messages {
+			if !slices.Contains(page.Types, msg.Type) {
+				page.Types = append(page.Types, msg.Type)
+			}
+		}
+
+		ok, matching := filter.matches(chat)
+		if !ok {
+			continue
+		}
+
+		item := adminChat{
+			Members:  chat.Members,
+			URL:      must(url.JoinPath("/admin/chats/", chat.Members[0], chat.Members[1])),
+			Messages: len(chat.Messages),
+			Matching: matching,
+		}
+		if len(chat.Messages) > 0 {
+			item.Last = time.Unix(chat.Messages[len(chat.Messages)-1].Timestamp, 0)
+		}
+		page.Chats = append(page.Chats, item)
+	}
+	s.Core.RUnlock()
+
+	slices.Sort(page.Types)
+	s.responseTemplate(w, r, "admin_chats.tmpl", page)
+}
+
+// adminMessage is a copy of a message, as the core may update its status
+// once unlocked.
+type adminMessage struct {
+	core.Message
+	Sent time.Time
+	JSON string
+}
+
+type adminChatPage struct {
+	Members  [2]string
+	Messages []adminMessage
+}
+
+// handleAdminChat shows a chat read-only, with the metadata and the JSON of
+// every message as stored in the snapshot.
+func (s *Handler) handleAdminChat(w http.ResponseWriter, r *http.Request) {
+	members := [2]string{r.PathValue("first"), r.PathValue("second")}
+	page := adminChatPage{Members: members}
+
+	s.Core.RLock()
+	chat := s.Core.GetChat(members)
+	if chat != nil {
+		for _, msg := range chat.Messages {
+			data, err := json.MarshalIndent(msg, "", "  ")
+			if err != nil {
+				log.Printf("Failed to encode message '%s': %v", msg.Id, err)
+			}
+
+			page.Messages = append(page.Messages, adminMessage{
+				Message: *copyMessages([]*core.Message{msg})[0],
+				Sent:    time.Unix(msg.Timestamp, 0),
+				JSON:    string(data),
+			})
+		}
+	}
+	s.Core.RUnlock()
+
+	if chat == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	s.responseTemplate(w, r, "admin_chat.tmpl", page)
+}
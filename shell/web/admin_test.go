@@ -0,0 +1,87 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+type AdminChatsTest struct {
+	Query  string
+	Status int
+	Chats  []string
+}
+
+func TestAdminChats(t *testing.T) {
+	tests := []AdminChatsTest{
+		{Query: "", Status: http.StatusOK, Chats: []string{"+11", "+22", "+33"}},
+		{Query: "participant=22", Status: http.StatusOK, Chats: []string{"+22"}},
+		{Query: "participant=%2B00", Status: http.StatusOK, Chats: []string{"+11", "+22", "+33"}},
+		{Query: "type=image", Status: http.StatusOK, Chats: []string{"+22"}},
+		{Query: "type=audio", Status: http.StatusOK},
+		{Query: "from=2026-01-11", Status: http.StatusOK, Chats: []string{"+22"}},
+		{Query: "to=2026-01-11", Status: http.StatusOK, Chats: []string{"+11"}},
+		// The To date is inclusive, up to the end of the day.
+		{Query: "to=2026-01-12", Status: http.StatusOK, Chats: []string{"+11", "+22"}},
+		{Query: "from=2026-01-10&to=2026-01-10", Status: http.StatusOK, Chats: []string{"+11"}},
+		{Query: "from=2026-01-12&to=2026-01-12&type=text", Status: http.StatusOK},
+		{Query: "participant=11&type=image", Status: http.StatusOK},
+		{Query: "from=yesterday", Status: http.StatusBadRequest},
+		{Query: "to=2026-13-01", Status: http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := core.NewCore(ctx)
+			c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+11"}), &core.Message{
+				From:      "+11",
+				To:        "+00",
+				Type:      "text",
+				Text:      &core.TextMessage{Body: "Hi"},
+				Timestamp: time.Date(2026, 1, 10, 12, 0, 0, 0, time.Local).Unix(),
+			})
+			c.AddMessage(c.GetOrCreateChat([2]string{"+00", "+22"}), &core.Message{
+				From:      "+22",
+				To:        "+00",
+				Type:      "image",
+				Image:     &core.ImageMessage{MediaId: "media"},
+				Timestamp: time.Date(2026, 1, 12, 23, 30, 0, 0, time.Local).Unix(),
+			})
+			c.GetOrCreateChat([2]string{"+00", "+33"})
+			handler := NewHandler(c, "+00", false)
+
+			// Act
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/admin/chats?"+test.Query, nil))
+
+			// Assert
+			if w.Code != test.Status {
+				t.Fatalf("Expected status %d, got %d: %s", test.Status, w.Code, w.Body)
+			}
+			if test.Status != http.StatusOK {
+				return
+			}
+
+			body := html.UnescapeString(w.Body.String())
+			for _, customer := range []string{"+11", "+22", "+33"} {
+				listed := strings.Contains(body, fmt.Sprintf(`href="/admin/chats/+00/%s"`, customer))
+				if expected := slices.Contains(test.Chats, customer); listed != expected {
+					t.Errorf("Expected the chat with %s to be listed: %v, got %v", customer, expected, listed)
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package web
 
 import (
 	"bytes"
+	"cmp"
 	"embed"
-	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,6 +11,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/andfenastari/chatsim/core"
 	"github.com/andfenastari/templatemap"
@@ -22,9 +26,10 @@ var assets embed.FS
 type Handler struct {
 	http.ServeMux
 
-	User         string
-	Devel        bool
-	SnapshotPath string
+	// User is the business number the customers talk to by default. The
+	// other business numbers can be picked in each chat.
+	User  string
+	Devel bool
 
 	Core *core.Core
 	Tmap templatemap.Map
@@ -34,7 +39,7 @@ func arr(els ...any) []any {
 	return els
 }
 
-func NewHandler(core *core.Core, user string, devel bool, snapshot string) *Handler {
+func NewHandler(core *core.Core, user string, devel bool) *Handler {
 	var err error
 
 	var tmap templatemap.Map
@@ -58,20 +63,33 @@ func NewHandler(core *core.Core, user string, devel bool, snapshot string) *Hand
 	}
 
 	handler := &Handler{
-		User:         user,
-		Core:         core,
-		Devel:        devel,
-		SnapshotPath: snapshot,
-		Tmap:         tmap,
+		User:  user,
+		Core:  core,
+		Devel: devel,
+		Tmap:  tmap,
 	}
 
 	handler.HandleFunc("GET /", handler.handleIndex)
+	handler.HandleFunc("GET /login", handler.handleLoginForm)
+	handler.HandleFunc("POST /login", handler.handleLogin)
+	handler.HandleFunc("POST /logout", handler.handleLogout)
 	handler.HandleFunc("POST /snapshot/save", handler.handleSaveSnapshot)
 	handler.HandleFunc("GET /snapshot/download", handler.handleDownloadSnapshot)
-	handler.HandleFunc("GET /chat/{peer}", handler.handleChat)
-	handler.HandleFunc("POST /chat/{peer}", handler.handleMessage)
-	handler.HandleFunc("GET /chat/{peer}/events", handler.handleEvents)
+	handler.HandleFunc("GET /snapshots", handler.handleSnapshots)
+	handler.HandleFunc("POST /snapshot/files/{name}/load", handler.handleLoadSnapshot)
+	handler.HandleFunc("POST /snapshot/reload", handler.handleReloadSnapshot)
+	handler.HandleFunc("POST /snapshot/reset", handler.handleResetSnapshot)
+	handler.HandleFunc("POST /snapshot/history/{name}/restore", handler.handleRestoreSnapshot)
+	handler.HandleFunc("GET /chat/{peer}", handler.handleLegacyChat)
+	handler.HandleFunc("GET /chat/{business}/{peer}", handler.handleChat)
+	handler.HandleFunc("POST /chat/{business}/{peer}", handler.handleMessage)
+	handler.HandleFunc("GET /chat/{business}/{peer}/events", handler.handleEvents)
+	handler.HandleFunc("GET /chat/{business}/{peer}/refresh", handler.handleRefresh)
 	handler.HandleFunc("GET /media/{media}", handler.handleGetMedia)
+	handler.HandleFunc("GET /webhooks", handler.handleWebhooks)
+	handler.HandleFunc("GET /admin/chats", handler.handleAdminChats)
+	handler.HandleFunc("GET /admin/chats/{first}/{second}", handler.handleAdminChat)
+	handler.HandleFunc("GET /metrics", handler.handleMetrics)
 	handler.HandleFunc("GET /chat/create", handler.handleCreateForm)
 	handler.HandleFunc("POST /chat/create", handler.handleCreate)
 
@@ -84,20 +102,209 @@ func NewHandler(core *core.Core, user string, devel bool, snapshot string) *Hand
 	return handler
 }
 
+// handleIndex opens the first chat of the customer logged in, or a new chat
+// with the default business number if the customer has none.
 func (s *Handler) handleIndex(w http.ResponseWriter, req *http.Request) {
-	if len(s.Core.Chats) == 0 {
-		http.Redirect(w, req, "/chat/create", http.StatusFound)
+	customer := s.customer(req)
+	if customer == "" {
+		http.Redirect(w, req, "/login", http.StatusFound)
+		return
+	}
+
+	s.Core.RLock()
+	links := s.ChatLinks(customer)
+	s.Core.RUnlock()
+
+	if len(links) == 0 {
+		http.Redirect(w, req, chatURL(s.User, customer), http.StatusFound)
 		return
 	} else {
-		peer := s.Core.Chats[0].Peer(s.User)
+		http.Redirect(w, req, links[0].URL(), http.StatusFound)
+		return
+	}
+}
+
+// customerCookie keeps the customer last played in the browser, which new
+// tabs start with. Each chat page plays the customer of its URL, so that tabs
+// can play different customers side by side.
+const customerCookie = "chatsim_customer"
+
+// customer returns the customer played by the request, the {peer} of chat
+// pages and the customer cookie otherwise.
+func (s *Handler) customer(r *http.Request) string {
+	if peer := r.PathValue("peer"); peer != "" {
+		return peer
+	}
+
+	cookie, err := r.Cookie(customerCookie)
+	if err != nil {
+		return ""
+	}
+	customer, _ := url.QueryUnescape(cookie.Value)
+	return customer
+}
+
+func (s *Handler) setCustomer(w http.ResponseWriter, customer string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     customerCookie,
+		Value:    url.QueryEscape(customer),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Customers returns the customers with a chat with a business number, in
+// the order of their first chat. The core must be locked by the caller.
+func (s *Handler) Customers() []string {
+	var customers []string
+	for _, link := range s.ChatLinks("") {
+		if !slices.Contains(customers, link.Peer) {
+			customers = append(customers, link.Peer)
+		}
+	}
+
+	return customers
+}
 
-		http.Redirect(w, req, must(url.JoinPath("/chat/", peer)), http.StatusFound)
+func (s *Handler) handleLoginForm(w http.ResponseWriter, r *http.Request) {
+	s.Core.RLock()
+	customers := s.Customers()
+	s.Core.RUnlock()
+
+	s.responseTemplate(w, r, "login.tmpl", customers)
+}
+
+// handleLogin switches the browser to the customer number given, which does
+// not need to have any chat yet.
+func (s *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
+	customer := r.FormValue("customer")
+	if customer == "" {
+		http.Error(w, "Must supply 'customer' value.", http.StatusBadRequest)
 		return
 	}
+
+	s.Core.RLock()
+	business := s.business(customer)
+	s.Core.RUnlock()
+	if business != nil {
+		http.Error(w, fmt.Sprintf("Number '%s' is a business number.", customer), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Logged in as %s", customer)
+	s.setCustomer(w, customer)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (s *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: customerCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// handleLegacyChat redirects the chat URLs from before there were several
+// business numbers to the chat with the default one.
+func (s *Handler) handleLegacyChat(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, chatURL(s.User, r.PathValue("peer")), http.StatusFound)
+}
+
+// Businesses returns the business numbers the customers can talk to,
+// starting with User. Without business accounts, User is the only one. The
+// core must be locked by the caller.
+func (s *Handler) Businesses() []*core.PhoneNumber {
+	user := s.Core.GetPhoneNumber(s.User)
+	if user == nil {
+		user = &core.PhoneNumber{Number: s.User}
+	}
+
+	businesses := []*core.PhoneNumber{user}
+	for _, phone := range s.Core.BusinessNumbers() {
+		if phone.Number != s.User {
+			businesses = append(businesses, phone)
+		}
+	}
+
+	return businesses
+}
+
+// business returns the business number with the given number, or nil when
+// it is not one of Businesses. The core must be locked by the caller.
+func (s *Handler) business(number string) *core.PhoneNumber {
+	for _, business := range s.Businesses() {
+		if business.Number == number {
+			return business
+		}
+	}
+
+	return nil
+}
+
+// ChatLink is a chat between a customer, Peer, and a business number.
+type ChatLink struct {
+	Business *core.PhoneNumber
+	Peer     string
+}
+
+func (l ChatLink) URL() string {
+	return chatURL(l.Business.Number, l.Peer)
+}
+
+func chatURL(business, peer string) string {
+	return must(url.JoinPath("/chat/", business, peer))
+}
+
+// ChatLinks returns the chats of customer with the business numbers, in the
+// order they were created. All the chats are returned when customer is
+// empty. The core must be locked by the caller.
+func (s *Handler) ChatLinks(customer string) []ChatLink {
+	var links []ChatLink
+	for _, chat := range s.Core.Chats {
+		for _, member := range chat.Members {
+			business := s.business(member)
+			if business == nil {
+				continue
+			}
+
+			link := ChatLink{Business: business, Peer: chat.Peer(member)}
+			if customer == "" || link.Peer == customer {
+				links = append(links, link)
+			}
+			break
+		}
+	}
+
+	return links
+}
+
+// chatPage is the chat of a customer with a business number, along with the
+// other business numbers the customer can switch to. The messages are copies,
+// as the core may add to the chat or update their status once unlocked.
+type chatPage struct {
+	ChatLink
+	Messages   []*core.Message
+	Businesses []*core.PhoneNumber
+}
+
+// chatLink returns the business number and customer addressed by the
+// {business} and {peer} path segments, failing when the business number is
+// unknown.
+func (s *Handler) chatLink(w http.ResponseWriter, r *http.Request) (link ChatLink, failed bool) {
+	s.Core.RLock()
+	business := s.business(r.PathValue("business"))
+	s.Core.RUnlock()
+
+	if business == nil {
+		http.Error(w, fmt.Sprintf("Unknown business number '%s'.", r.PathValue("business")), http.StatusNotFound)
+		return ChatLink{}, true
+	}
+
+	return ChatLink{Business: business, Peer: r.PathValue("peer")}, false
 }
 
 func (s *Handler) handleSaveSnapshot(w http.ResponseWriter, r *http.Request) {
-	err := s.Core.SaveSnapshot(s.SnapshotPath)
+	s.Core.RLock()
+	err := s.Core.SaveSnapshot(s.Core.SnapshotPath)
+	s.Core.RUnlock()
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -105,20 +312,128 @@ func (s *Handler) handleSaveSnapshot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDownloadSnapshot sends the snapshot in the format of the format query
+// parameter, JSON by default.
 func (s *Handler) handleDownloadSnapshot(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+	format := core.FormatJSON
+	if r.URL.Query().Has("format") {
+		format = core.SnapshotFormat(r.URL.Query().Get("format"))
+	}
+
+	if !slices.Contains(core.SnapshotFormats, format) {
+		http.Error(w, fmt.Sprintf("Unsupported snapshot format '%s'.", format), http.StatusBadRequest)
+		return
+	}
+
+	contentTypes := map[core.SnapshotFormat]string{
+		core.FormatJSON:  "application/json",
+		core.FormatTar:   "application/x-tar",
+		core.FormatTarGz: "application/gzip",
+		core.FormatZip:   "application/zip",
+	}
+
+	// The snapshot is written to a temporary file first, so that a slow
+	// client does not hold the core locked.
+	file, err := os.CreateTemp("", "chatsim-snapshot-*")
+	if err != nil {
+		log.Printf("Failed to create snapshot file: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	s.Core.RLock()
+	err = s.Core.WriteSnapshot(file, format)
+	s.Core.RUnlock()
+	if err != nil {
+		log.Printf("Failed to write snapshot: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="snapshot.%s"`, format))
 	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+type snapshotsPage struct {
+	Path    string
+	Current string
+	Files   []*core.SnapshotFile
+	History []*core.SnapshotFile
+}
+
+func (s *Handler) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	s.Core.RLock()
+	page := snapshotsPage{
+		Path:    s.Core.SnapshotPath,
+		Current: filepath.Base(s.Core.SnapshotPath),
+	}
+	files, err := s.Core.SnapshotFiles()
+	if err == nil {
+		page.Files = files
+		page.History, err = s.Core.SnapshotHistory(s.Core.SnapshotPath)
+	}
+	s.Core.RUnlock()
 
-	err := json.NewEncoder(w).Encode(s.Core.Snapshot)
 	if err != nil {
-		log.Printf("Failed to send snapshot: %v", err)
+		log.Print(err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+
+	s.responseTemplate(w, r, "snapshots.tmpl", page)
+}
+
+func (s *Handler) handleLoadSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.replaceState(w, name, func() error {
+		return s.Core.SwitchSnapshot(name)
+	})
+}
+
+func (s *Handler) handleReloadSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.replaceState(w, "current", s.Core.ReloadSnapshot)
+}
+
+func (s *Handler) handleResetSnapshot(w http.ResponseWriter, r *http.Request) {
+	s.replaceState(w, "empty", func() error {
+		s.Core.Reset()
+		return nil
+	})
+}
+
+func (s *Handler) handleRestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.replaceState(w, name, func() error {
+		return s.Core.RestoreSnapshot(s.Core.SnapshotPath, name)
+	})
+}
+
+// replaceState locks the core to replace its state with the named snapshot.
+// The chats may have changed entirely, so the whole page is reloaded.
+func (s *Handler) replaceState(w http.ResponseWriter, name string, replace func() error) {
+	s.Core.Lock()
+	err := replace()
+	s.Core.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to load snapshot '%s': %v", name, err)
+		http.Error(w, fmt.Sprintf("Failed to load snapshot '%s'.", name), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/")
 }
 
-func (s *Handler) handleCreateForm(w http.ResponseWriter, req *http.Request) {
-	s.responseTemplate(w, "create.tmpl", nil)
+func (s *Handler) handleCreateForm(w http.ResponseWriter, r *http.Request) {
+	s.Core.RLock()
+	businesses := s.Businesses()
+	s.Core.RUnlock()
+
+	s.responseTemplate(w, r, "create.tmpl", businesses)
 }
 
 func (s *Handler) handleCreate(w http.ResponseWriter, r *http.Request) {
@@ -129,31 +444,76 @@ func (s *Handler) handleCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Core.Lock()
-	s.Core.GetOrCreateChat([2]string{s.User, peer})
+	business := s.business(cmp.Or(r.FormValue("business"), s.User))
+	if business == nil {
+		s.Core.Unlock()
+		http.Error(w, fmt.Sprintf("Unknown business number '%s'.", r.FormValue("business")), http.StatusBadRequest)
+		return
+	}
+	s.Core.GetOrCreateChat([2]string{business.Number, peer})
 	for _, chat := range s.Core.Chats {
 		log.Print(chat)
 	}
 	s.Core.Unlock()
 
-	http.Redirect(w, r, "/chat/"+peer, http.StatusFound)
+	http.Redirect(w, r, chatURL(business.Number, peer), http.StatusFound)
 }
 
 func (s *Handler) handleChat(w http.ResponseWriter, r *http.Request) {
-	peer := r.PathValue("peer")
+	link, failed := s.chatLink(w, r)
+	if failed {
+		return
+	}
 
 	s.Core.Lock()
-	chat := s.Core.GetOrCreateChat([2]string{s.User, peer})
+	chat := s.Core.GetOrCreateChat([2]string{link.Business.Number, link.Peer})
+	s.markRead(link.Business.Number, chat.Messages...)
+	page := chatPage{ChatLink: link, Messages: copyMessages(chat.Messages), Businesses: s.Businesses()}
 	s.Core.Unlock()
 
-	for _, msg := range chat.Messages {
-		log.Print(msg.Text)
+	s.setCustomer(w, link.Peer)
+
+	s.responseTemplate(w, r, "chat.tmpl", page)
+}
+
+// copyMessages copies msgs for rendering once the core is unlocked, along
+// with their status and error. The core must be locked by the caller.
+func copyMessages(msgs []*core.Message) []*core.Message {
+	copies := make([]*core.Message, len(msgs))
+	for i, msg := range msgs {
+		copied := *msg
+		if msg.Error != nil {
+			err := *msg.Error
+			copied.Error = &err
+		}
+		copies[i] = &copied
 	}
 
-	s.responseTemplate(w, "chat.tmpl", chat)
+	return copies
+}
+
+// markRead marks the messages sent by the business number to the simulated
+// user as read. The core must be locked by the caller.
+func (s *Handler) markRead(business string, msgs ...*core.Message) {
+	for _, msg := range msgs {
+		if msg.From != business || msg.Status == core.StatusRead || msg.Status == core.StatusFailed {
+			continue
+		}
+
+		err := s.Core.MarkRead(msg)
+		if err != nil {
+			log.Print(err)
+		}
+	}
 }
 
 func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
-	peer := r.PathValue("peer")
+	link, failed := s.chatLink(w, r)
+	if failed {
+		return
+	}
+
+	peer, business := link.Peer, link.Business.Number
 	typ := r.FormValue("type")
 
 	var msg *core.Message
@@ -165,7 +525,7 @@ func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
 		}
 		msg = &core.Message{
 			From: peer,
-			To:   s.User,
+			To:   business,
 			Type: "text",
 			Text: &core.TextMessage{Body: text},
 		}
@@ -175,15 +535,16 @@ func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.Core.Lock()
-		id := s.Core.AddMedia(s.User, "PNG", data)
-		s.Core.Unlock()
+		id, failed := s.addMedia(w, business, "PNG", data)
+		if failed {
+			return
+		}
 
 		caption := r.FormValue("caption")
 
 		msg = &core.Message{
 			From: peer,
-			To:   s.User,
+			To:   business,
 			Type: "image",
 			Image: &core.ImageMessage{
 				MediaId: id,
@@ -197,14 +558,15 @@ func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		s.Core.Lock()
-		id := s.Core.AddMedia(s.User, "MP3", data)
-		s.Core.Unlock()
+		id, failed := s.addMedia(w, business, "MP3", data)
+		if failed {
+			return
+		}
 
 		msg = &core.Message{
 			From: peer,
-			To:   s.User,
-			Type: "image",
+			To:   business,
+			Type: "audio",
 			Audio: &core.AudioMessage{
 				MediaId: id,
 			},
@@ -218,13 +580,14 @@ func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
 
 		caption := r.FormValue("caption")
 
-		s.Core.Lock()
-		id := s.Core.AddMedia(s.User, "Microsoft Excel", data)
-		s.Core.Unlock()
+		id, failed := s.addMedia(w, business, "Microsoft Excel", data)
+		if failed {
+			return
+		}
 
 		msg = &core.Message{
 			From: peer,
-			To:   s.User,
+			To:   business,
 			Type: "document",
 			Document: &core.DocumentMessage{
 				MediaId:  id,
@@ -239,11 +602,26 @@ func (s *Handler) handleMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.Core.Lock()
-	chat := s.Core.GetOrCreateChat([2]string{s.User, peer})
+	chat := s.Core.GetOrCreateChat([2]string{business, peer})
 	s.Core.AddMessage(chat, msg)
+	copied := copyMessages([]*core.Message{msg})[0]
+	s.Core.Unlock()
+
+	s.responseTemplate(w, r, "message.tmpl", arr(business, copied))
+}
+
+func (s *Handler) addMedia(w http.ResponseWriter, business, typ string, data []byte) (id string, failed bool) {
+	s.Core.Lock()
+	id, err := s.Core.AddMedia(business, typ, data)
 	s.Core.Unlock()
 
-	s.responseTemplate(w, "message.tmpl", msg)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return "", true
+	}
+
+	return id, false
 }
 
 func readFile(w http.ResponseWriter, r *http.Request, name string) (data []byte, filename string, failed bool) {
@@ -266,31 +644,132 @@ func readFile(w http.ResponseWriter, r *http.Request, name string) (data []byte,
 }
 
 func (s *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
-	peer := r.PathValue("peer")
-	log.Printf("event connection: %s", peer)
+	link, failed := s.chatLink(w, r)
+	if failed {
+		return
+	}
+
+	peer, business := link.Peer, link.Business.Number
+	log.Printf("event connection: %s with %s", peer, business)
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
+	s.Core.Lock()
+	chat := s.Core.GetOrCreateChat([2]string{business, peer})
+	s.Core.Unlock()
+
 	done := r.Context().Done()
-	events := s.Core.AddListener()
-	defer s.Core.RemoveListener(events)
+	// A tab that stops reading is disconnected, and the browser reconnects
+	// once it catches up.
+	listener := s.Core.AddListener(core.ListenerOptions{
+		Overflow: core.Disconnect,
+		Filter: core.EventFilter{
+			Types: []core.EventType{
+				core.EventMessageCreated,
+				core.EventStatusChanged,
+				core.EventSnapshotLoaded,
+				core.EventReset,
+			},
+			Chat: chat,
+		},
+	})
+	defer s.Core.RemoveListener(listener)
 
 out:
 	for {
 		select {
 		case <-done:
 			break out
-		case msg := <-events:
-			if msg.From != s.User || msg.To != peer {
-				continue
+		case event, ok := <-listener.C:
+			if !ok {
+				break out
+			}
+
+			msg := event.Message
+			switch event.Type {
+			case core.EventMessageCreated:
+				if msg.From != business {
+					continue
+				}
+				// The chat is open, so the message is read as soon as it is
+				// shown, and is shown as read.
+				s.Core.Lock()
+				s.markRead(business, msg)
+				copied := copyMessages([]*core.Message{msg})[0]
+				s.Core.Unlock()
+				s.responseSSE(w, "message", "message.tmpl", arr(business, copied))
+			case core.EventStatusChanged:
+				if msg.From != peer {
+					continue
+				}
+				s.responseSSE(w, "status", "status.tmpl", event.Status)
+			case core.EventSnapshotLoaded, core.EventReset:
+				// The chat this stream follows was replaced, so the page
+				// reloads itself, opening a new stream.
+				fmt.Fprint(w, "event: reload\ndata: \n\n")
+				w.(http.Flusher).Flush()
+				break out
 			}
-			s.responseSSE(w, "message.tmpl", msg)
 		}
 	}
 
-	log.Print("event disconnected: %s", peer)
+	log.Printf("event disconnected: %s with %s", peer, business)
+}
+
+// handleRefresh reloads the chat page once the state was replaced, or goes
+// back to the index if the chat is gone.
+func (s *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	business, peer := r.PathValue("business"), r.PathValue("peer")
+
+	s.Core.RLock()
+	chat := s.Core.GetChat([2]string{business, peer})
+	if s.business(business) == nil {
+		chat = nil
+	}
+	s.Core.RUnlock()
+
+	if chat != nil {
+		w.Header().Set("HX-Refresh", "true")
+	} else {
+		w.Header().Set("HX-Redirect", "/")
+	}
+}
+
+// webhookPage is a webhook with copies of its deliveries, as the core keeps
+// updating them once unlocked.
+type webhookPage struct {
+	*core.Webhook
+	Deliveries []core.Delivery
+}
+
+func (s *Handler) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	var pages []webhookPage
+
+	s.Core.RLock()
+	for _, webhook := range s.Core.Webhooks {
+		page := webhookPage{Webhook: webhook}
+		for _, delivery := range s.Core.WebhookDeliveries(webhook.Id) {
+			page.Deliveries = append(page.Deliveries, *delivery)
+		}
+		pages = append(pages, page)
+	}
+	s.Core.RUnlock()
+
+	s.responseTemplate(w, r, "webhooks.tmpl", pages)
+}
+
+// handleMetrics reports the event listener statistics in the Prometheus text
+// format.
+func (s *Handler) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := s.Core.ListenerStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "chatsim_listeners %d\n", stats.Listeners)
+	fmt.Fprintf(w, "chatsim_events_published_total %d\n", stats.Published)
+	fmt.Fprintf(w, "chatsim_events_dropped_total %d\n", stats.Dropped)
+	fmt.Fprintf(w, "chatsim_listeners_disconnected_total %d\n", stats.Disconnected)
 }
 
 func (s *Handler) handleGetMedia(w http.ResponseWriter, r *http.Request) {
@@ -300,13 +779,31 @@ func (s *Handler) handleGetMedia(w http.ResponseWriter, r *http.Request) {
 	media := s.Core.GetMedia(id)
 	s.Core.RUnlock()
 
+	if media == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := s.Core.OpenMedia(media)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
 	w.Header().Set("Content-Type", media.ContentType())
-	w.Write(media.Data)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, media.Hash))
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
+// templateContext is the data of every template. Customer is the customer
+// played by the tab, if any, and ChatLinks are their chats.
 type templateContext struct {
-	State *Handler
-	Data  any
+	State     *Handler
+	Customer  string
+	ChatLinks []ChatLink
+	Data      any
 }
 
 func (s *Handler) template(path string) *template.Template {
@@ -333,19 +830,29 @@ func (s *Handler) template(path string) *template.Template {
 	return tmpl
 }
 
-func (s *Handler) responseTemplate(w http.ResponseWriter, path string, data any) {
+// responseTemplate renders a page along with the chats of the customer,
+// which are listed under the read lock. The core must not be locked by the
+// caller.
+func (s *Handler) responseTemplate(w http.ResponseWriter, r *http.Request, path string, data any) {
 	tmpl := s.template(path)
+	customer := s.customer(r)
+
+	s.Core.RLock()
+	links := s.ChatLinks(customer)
+	s.Core.RUnlock()
 
 	err := tmpl.Execute(w, templateContext{
-		State: s,
-		Data:  data,
+		State:     s,
+		Customer:  customer,
+		ChatLinks: links,
+		Data:      data,
 	})
 	if err != nil {
 		log.Fatalf("Failed to render template %s: %v", path, err)
 	}
 }
 
-func (s *Handler) responseSSE(w http.ResponseWriter, path string, data any) {
+func (s *Handler) responseSSE(w http.ResponseWriter, event, path string, data any) {
 	tmpl := s.template(path)
 
 	buf := new(bytes.Buffer)
@@ -357,6 +864,7 @@ func (s *Handler) responseSSE(w http.ResponseWriter, path string, data any) {
 		log.Fatalf("Failed to render template %s: %v", path, err)
 	}
 
+	fmt.Fprintf(w, "event: %s\n", event)
 	lines := bytes.Split(buf.Bytes(), []byte("\n"))
 	for _, line := range lines {
 		w.Write([]byte("data: "))
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/andfenastari/chatsim/core"
+)
+
+// newTestHandler serves the chats of the customers +11 and +22 with the
+// business number +00.
+func newTestHandler(ctx context.Context) *Handler {
+	c := core.NewCore(ctx)
+	for _, customer := range []string{"+11", "+22"} {
+		chat := c.GetOrCreateChat([2]string{"+00", customer})
+		c.AddMessage(chat, &core.Message{From: customer, To: "+00", Type: "text", Text: &core.TextMessage{Body: "Hi"}})
+	}
+
+	return NewHandler(c, "+00", false)
+}
+
+type CustomerTest struct {
+	Method string
+	Path   string
+	Form   url.Values
+	Cookie string
+
+	Status   int
+	Location string
+	// SetCookie is the customer stored in the cookie by the response.
+	SetCookie string
+	Contains  []string
+	Excludes  []string
+}
+
+func TestCustomer(t *testing.T) {
+	tests := []CustomerTest{
+		{Method: "GET", Path: "/", Status: http.StatusFound, Location: "/login"},
+		{Method: "GET", Path: "/", Cookie: "+22", Status: http.StatusFound, Location: "/chat/+00/+22"},
+		{Method: "GET", Path: "/", Cookie: "+33", Status: http.StatusFound, Location: "/chat/+00/+33"},
+		{
+			Method:   "GET",
+			Path:     "/login",
+			Cookie:   "+11",
+			Status:   http.StatusOK,
+			Contains: []string{"Playing +11", `href="/chat/+00/+11"`},
+			Excludes: []string{`href="/chat/+00/+22"`},
+		},
+		{
+			// Tabs play the customer of their chat, whatever the cookie,
+			// which new tabs start with.
+			Method:    "GET",
+			Path:      "/chat/+00/+22",
+			Cookie:    "+11",
+			Status:    http.StatusOK,
+			SetCookie: "+22",
+			Contains:  []string{"Playing +22", `href="/chat/+00/+22"`},
+			Excludes:  []string{"Playing +11", `href="/chat/+00/+11"`},
+		},
+		{
+			Method:    "POST",
+			Path:      "/login",
+			Form:      url.Values{"customer": {"+33"}},
+			Cookie:    "+11",
+			Status:    http.StatusFound,
+			Location:  "/",
+			SetCookie: "+33",
+		},
+		{Method: "POST", Path: "/login", Form: url.Values{"customer": {"+00"}}, Status: http.StatusBadRequest},
+		{Method: "POST", Path: "/login", Status: http.StatusBadRequest},
+	}
+
+	for i, test := range tests {
+		t.Run(fmt.Sprintf("Test %d", i), func(t *testing.T) {
+
+			// Arrange
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			handler := newTestHandler(ctx)
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(test.Method, test.Path, strings.NewReader(test.Form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if test.Cookie != "" {
+				req.AddCookie(&http.Cookie{Name: customerCookie, Value: url.QueryEscape(test.Cookie)})
+			}
+
+			// Act
+			handler.ServeHTTP(w, req)
+
+			// Assert
+			res := w.Result()
+			if res.StatusCode != test.Status {
+				t.Fatalf("Expected status %d, got %d: %s", test.Status, res.StatusCode, w.Body)
+			}
+			if location := res.Header.Get("Location"); location != test.Location {
+				t.Errorf("Expected a redirect to '%s', got '%s'", test.Location, location)
+			}
+
+			customer := ""
+			for _, cookie := range res.Cookies() {
+				if cookie.Name == customerCookie {
+					customer, _ = url.QueryUnescape(cookie.Value)
+				}
+			}
+			if customer != test.SetCookie {
+				t.Errorf("Expected the cookie to be set to '%s', got '%s'", test.SetCookie, customer)
+			}
+
+			body := html.UnescapeString(w.Body.String())
+			for _, s := range test.Contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("Expected the page to contain %s", s)
+				}
+			}
+			for _, s := range test.Excludes {
+				if strings.Contains(body, s) {
+					t.Errorf("Expected the page not to contain %s", s)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentChat renders a chat, and posts to it, while the business
+// sends messages that the core fails, for the race detector to catch the
+// templates reading messages the core is updating.
+func TestConcurrentChat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := newTestHandler(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		chat := handler.Core.GetChat([2]string{"+00", "+11"})
+		for i := 0; i < 100; i++ {
+			msg := &core.Message{From: "+00", To: "+11", Type: "text", Text: &core.TextMessage{Body: fmt.Sprint(i)}}
+
+			handler.Core.Lock()
+			handler.Core.AddMessage(chat, msg)
+			if i%2 == 0 {
+				handler.Core.UpdateStatus(msg, core.StatusFailed, core.NewError(core.ErrUndeliverable, "Unreachable"))
+			}
+			handler.Core.Unlock()
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/chat/+00/+11", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+
+		w = httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/chat/+00/+11", strings.NewReader("type=text&text=Hi"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+	}
+}